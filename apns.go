@@ -1,58 +1,411 @@
 package apns
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
-	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Notification struct {
 	DeviceToken        string
 	ExpireAfterSeconds int
+	// ExpiryUnix, if not 0, is the absolute expiry as a Unix timestamp and
+	// takes precedence over ExpireAfterSeconds, which is relative to the send.
+	ExpiryUnix int64
+	// Priority is only sent in the framed format, see WithFramedFormat.
+	// 10 sends right away, 5 at a time that conserves the device's power,
+	// whatever the payload: alerts can be sent with 5 too. 0 leaves it to
+	// Apple, which means 10.
+	Priority uint8
 
 	Payload *Payload
+	// RawPayload, if set, is sent verbatim instead of marshaling Payload,
+	// e.g. to marshal a payload sent to many tokens only once, or one that
+	// is already JSON. It must be a JSON object and is held to the same size
+	// limit; see WithStrictRawPayload to require an aps key too.
+	RawPayload []byte
+	// Meta is never sent, it's for correlating the notification with the
+	// caller's own data: the WithOnDropped callback gets the notification,
+	// and NotificationError.Meta returns it.
+	Meta interface{}
+
+	// set on the copy resent after a Retry, so it's only retried once
+	retried bool
+	// the payload a resent copy was first sent with
+	sent []byte
+}
+
+// Copy of n to change, e.g. per recipient, without changing n: the payload
+// and its custom keys are copied too. Custom values and SetCustomData data
+// are still shared, replace them rather than changing them.
+func (n *Notification) Clone() *Notification {
+	c := *n
+	if n.Payload != nil {
+		c.Payload = n.Payload.clone()
+	}
+	if n.RawPayload != nil {
+		c.RawPayload = append([]byte(nil), n.RawPayload...)
+	}
+	return &c
 }
 
 // An Apn contain a ErrorChan channle when connected to apple server. When a notification sent wrong, you can get the error infomation from this channel.
+// ErrorChan must be read: by default a full ErrorChan stalls sending until it is, see WithErrorChanPolicy.
 type Apn struct {
 	ErrorChan <-chan error
 
-	server     string
+	// Notifications Apple rejected that won't be resent, if WithDeadLetterChan
+	// is set; nil otherwise.
+	DeadLetterChan <-chan DeadLetter
+
+	newLike    func(certificate tls.Certificate) (*Apn, error)
+	parent     *Apn // of a Broadcast sibling, sharing its stats
+	confLock   sync.Mutex
 	conf       *tls.Config
+	server     string
+	connLock   sync.Mutex
 	conn       *tls.Conn
-	timeout    time.Duration
+	timeout    int64 // time.Duration, accessed atomically
 	identifier uint32
 
+	dialTimeout     time.Duration
+	tlsTimeout      time.Duration // WithHandshakeTimeout
+	drainTimeout    time.Duration
+	writeTimeout    time.Duration
+	idleGrace       time.Duration
+	idlePing        time.Duration
+	localAddr       net.Addr
+	bgExpiry        time.Duration // WithBackgroundExpiry
+	network         string
+	nagle           bool // WithNoDelay(false)
+	derivedName     bool // conf.ServerName is the server's host
+	dial            func(network, addr string) (net.Conn, error)
+	logger          Logger
+	events          StructuredLogger
+	onConnect       func(state tls.ConnectionState)
+	tokenFilter     func(token string) bool
+	tokenLimiter    *tokenLimiter
+	tokenShown      int // WithTokenRedaction
+	onDropped       func(n *Notification, reason error)
+	onRawRead       func(p []byte)
+	onReconnect     func() []*Notification
+	hasConnected    bool
+	maxPayloadBytes int
+	payloadWarnAt   int
+	dryRun          bool
+	strictRaw       bool
+	strictKeys      bool
+	truncateBody    bool
+	eagerConnect    bool
+	warm            bool
+	command         uint8
+
+	generation uint32
+
 	sendChan  chan *sendArg
 	errorChan chan error
+	queued    int32
+	aborted   int32
+	workers   int32
+	connSends int32
+	lastSend  int64 // unix nano, accessed atomically
+	done      chan struct{}
+	closeOnce sync.Once
+
+	classifier          func(err error) Disposition
+	batchPolicy         BatchPolicy
+	errorChanPolicy     ErrorChanPolicy
+	errorChanBufferSize int
+	droppedErrors       uint64
+	deadLetterSize      int
+	deadLetters         chan DeadLetter
+
+	lastErrorLock sync.Mutex
+	lastError     error
+
+	validatorLock sync.Mutex
+	validators    []func(n *Notification) error
+
+	// Channels SendAndWait watches Apple's error responses on.
+	watchLock sync.Mutex
+	watchers  map[chan NotificationError]bool
+
+	// Badge-only notifications waiting out the coalescing window, by token.
+	coalesceWindow time.Duration
+	coalesceLock   sync.Mutex
+	coalesced      map[string]*Notification
+
+	// Counted sends, connects and errors, see Stats.
+	statsLock sync.Mutex
+	stats     Stats
+
+	// Notifications written to the current connection, oldest first. Apple
+	// drops everything sent after a failed notification, so the part after
+	// an error's identifier goes to resend and is sent on the next connection.
+	inflightLock sync.Mutex
+	inflight     []inFlight
+	resend       []*Notification
+	maxInFlight  int
+	maxQueueAge  time.Duration
+
+	maxSendsPerConn int
+
+	// Frames waiting in writer to be flushed to the connection, when
+	// writeBufferSize is set. They're flushed once the buffer fills, by
+	// flushAt, and before the connection closes.
+	writeBufferSize int
+	flushInterval   time.Duration
+	writeLock       sync.Mutex
+	writer          *bufio.Writer
+	flushAt         time.Time
+}
+
+type inFlight struct {
+	identifier   uint32
+	notification *Notification
+	expiry       uint32
+	enqueued     time.Time
+	payload      []byte
 }
 
 // New Apn with cert_filename and key_filename.
+// The connection is closed after idling for timeout. A timeout of 0 (or less)
+// keeps it open until an error closes it.
+//
+// Deprecated: use NewWithOptions with WithTimeout.
 func New(certPEMBlock, keyPEMBlock []byte, server string, timeout time.Duration) (*Apn, error) {
-	echan := make(chan error)
+	return NewWithOptions(certPEMBlock, keyPEMBlock, server, WithTimeout(timeout))
+}
+
+// New Apn with a single PEM bundle holding both the cert and the key, in either
+// order. See New for timeout.
+func NewFromCombinedPEM(bundle []byte, server string, timeout time.Duration) (*Apn, error) {
+	certPEMBlock, keyPEMBlock, err := splitCombinedPEM(bundle)
+	if err != nil {
+		return nil, err
+	}
+	return NewWithOptions(certPEMBlock, keyPEMBlock, server, WithTimeout(timeout))
+}
+
+// Split a PEM bundle into its certificate blocks and its private key block.
+func splitCombinedPEM(bundle []byte) (certPEMBlock, keyPEMBlock []byte, err error) {
+	for {
+		var block *pem.Block
+		block, bundle = pem.Decode(bundle)
+		if block == nil {
+			break
+		}
+		switch {
+		case block.Type == "CERTIFICATE":
+			certPEMBlock = append(certPEMBlock, pem.EncodeToMemory(block)...)
+		case strings.HasSuffix(block.Type, "PRIVATE KEY") && keyPEMBlock == nil:
+			keyPEMBlock = pem.EncodeToMemory(block)
+		}
+	}
+	if certPEMBlock == nil {
+		return nil, nil, ErrNoCertificateInPEM
+	}
+	if keyPEMBlock == nil {
+		return nil, nil, ErrNoPrivateKeyInPEM
+	}
+	return certPEMBlock, keyPEMBlock, nil
+}
 
+// Load a cert/key pair like tls.X509KeyPair, failing with
+// ErrNoCertificateInPEM, ErrNoPrivateKeyInPEM or ErrCertKeyMismatch for the
+// usual mistakes instead of its generic errors.
+func keyPair(certPEMBlock, keyPEMBlock []byte) (tls.Certificate, error) {
 	certificate, err := tls.X509KeyPair(certPEMBlock, keyPEMBlock)
+	if err == nil {
+		return certificate, nil
+	}
+	certDER := findPEM(certPEMBlock, func(typ string) bool { return typ == "CERTIFICATE" })
+	if certDER == nil {
+		return certificate, ErrNoCertificateInPEM
+	}
+	keyDER := findPEM(keyPEMBlock, func(typ string) bool { return strings.HasSuffix(typ, "PRIVATE KEY") })
+	if keyDER == nil {
+		return certificate, ErrNoPrivateKeyInPEM
+	}
+	leaf, certErr := x509.ParseCertificate(certDER)
+	key, keyErr := parsePrivateKey(keyDER)
+	if certErr == nil && keyErr == nil {
+		if public, ok := leaf.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); ok && !public.Equal(key.Public()) {
+			return certificate, ErrCertKeyMismatch
+		}
+	}
+	return certificate, err
+}
+
+// The bytes of the first PEM block in data whose type matches, or nil.
+func findPEM(data []byte, match func(typ string) bool) []byte {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil
+		}
+		if match(block.Type) {
+			return block.Bytes
+		}
+	}
+}
+
+// Parse a PKCS #1, PKCS #8 or EC private key, like tls.X509KeyPair does.
+func parsePrivateKey(der []byte) (crypto.Signer, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+	}
+	return x509.ParseECPrivateKey(der)
+}
+
+// New Apn doing TLS over conn, already connected to Apple or whatever stands
+// in for it, instead of dialing. conn is only good for one connection: once it
+// closes, e.g. after idling for timeout, sending fails with ErrConnUsed. See New
+// for timeout. The certificate is verified against the host of conn's remote
+// address, so a conn without one, like a net.Pipe, needs WithServerName.
+func NewWithConn(conn net.Conn, certPEMBlock, keyPEMBlock []byte, timeout time.Duration, opts ...Option) (*Apn, error) {
+	var used int32
+	dial := func(network, addr string) (net.Conn, error) {
+		if !atomic.CompareAndSwapInt32(&used, 0, 1) {
+			return nil, ErrConnUsed
+		}
+		return conn, nil
+	}
+	opts = append([]Option{WithTimeout(timeout), WithDialFunc(dial)}, opts...)
+	apn, err := NewWithOptions(certPEMBlock, keyPEMBlock, conn.RemoteAddr().String(), opts...)
 	if err != nil {
 		return nil, err
 	}
+	// a copy would only get ErrConnUsed from dial
+	apn.newLike = nil
+	return apn, nil
+}
 
+// New Apn with PEM encoded cert and key, sending to server, configured by opts.
+// An expired certificate fails with ErrCertificateExpired.
+func NewWithOptions(certPEMBlock, keyPEMBlock []byte, server string, opts ...Option) (*Apn, error) {
+	certificate, err := keyPair(certPEMBlock, keyPEMBlock)
+	if err != nil {
+		return nil, err
+	}
+	return newWithCertificate(certificate, server, opts...)
+}
+
+func newWithCertificate(certificate tls.Certificate, server string, opts ...Option) (*Apn, error) {
 	conf := &tls.Config{Certificates: []tls.Certificate{certificate}}
 
 	ret := &Apn{
-		ErrorChan: echan,
-		server:    server,
-		conf:      conf,
-		timeout:   timeout,
-		sendChan:  make(chan *sendArg),
-		errorChan: echan,
+		server:          server,
+		conf:            conf,
+		maxPayloadBytes: maxPayloadBytes,
+		command:         CommandEnhanced,
+		sendChan:        make(chan *sendArg),
+		done:            make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(ret)
+	}
+	if ret.command != CommandEnhanced && ret.command != CommandFramed {
+		return nil, ErrUnsupportedCommand
+	}
+	if err := ret.checkExpiry(certificate); err != nil {
+		return nil, err
+	}
+	if conf.ServerName == "" {
+		// What tls.Dial would use, set here so a WithDialFunc connection
+		// verifies the same name.
+		if host, _, err := net.SplitHostPort(server); err == nil {
+			conf.ServerName = host
+			ret.derivedName = true
+		}
+	}
+	echan := make(chan error, ret.errorChanBufferSize)
+	ret.ErrorChan = echan
+	ret.errorChan = echan
+	if ret.deadLetterSize > 0 {
+		ret.deadLetters = make(chan DeadLetter, ret.deadLetterSize)
+		ret.DeadLetterChan = ret.deadLetters
+	}
+
+	ret.newLike = func(certificate tls.Certificate) (*Apn, error) {
+		// the caller sets up conf and server before the copy connects
+		like := func(a *Apn) {
+			a.eagerConnect = false
+			a.parent = ret
+			a.tokenLimiter = ret.tokenLimiter
+			a.deadLetterSize = 0
+			a.deadLetters = ret.deadLetters
+			a.DeadLetterChan = ret.DeadLetterChan
+		}
+		return newWithCertificate(certificate, server, append(opts[:len(opts):len(opts)], like)...)
 	}
 
-	go sendLoop(ret)
-	return ret, err
+	ret.spawn(func() { sendLoop(ret) })
+	if ret.eagerConnect {
+		if err := ret.Reconnect(); err != nil {
+			ret.Close()
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// Warn when the certificate expires within this long.
+const expiryWarning = 30 * 24 * time.Hour
+
+// Fail if certificate has expired, and log a warning if it's about to.
+func (a *Apn) checkExpiry(certificate tls.Certificate) error {
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return err
+	}
+	if time.Now().After(leaf.NotAfter) {
+		return fmt.Errorf("%w on %s", ErrCertificateExpired, leaf.NotAfter.Format(time.RFC3339))
+	}
+	if time.Until(leaf.NotAfter) < expiryWarning {
+		a.logf("certificate expires soon, on %s", leaf.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Replace the certificate with a new cert/key pair and reconnect, so every
+// notification sent after UpdateCertificate returns uses the new certificate.
+func (a *Apn) UpdateCertificate(certPEMBlock, keyPEMBlock []byte) error {
+	certificate, err := keyPair(certPEMBlock, keyPEMBlock)
+	if err != nil {
+		return err
+	}
+	if err := a.checkExpiry(certificate); err != nil {
+		return err
+	}
+
+	a.confLock.Lock()
+	conf := a.conf.Clone()
+	conf.Certificates = []tls.Certificate{certificate}
+	a.conf = conf
+	a.confLock.Unlock()
+
+	return a.Reconnect()
 }
 
 func (a *Apn) GetErrorChan() <-chan error {
@@ -61,128 +414,1390 @@ func (a *Apn) GetErrorChan() <-chan error {
 
 // Send a notification to iOS
 func (a *Apn) Send(notification *Notification) error {
+	_, err := a.SendID(notification)
+	return err
+}
+
+// Send a notification to iOS, returning the identifier it was sent with.
+// Error responses from Apple refer to notifications by this identifier.
+// A badge update held back by WithCoalesceBadgeUpdates gets identifier 0.
+func (a *Apn) SendID(notification *Notification) (uint32, error) {
+	r := a.SendWithResult(notification)
+	return r.Identifier, r.Err
+}
+
+// The result of sending to one device token.
+type SendResult struct {
+	Token      string
+	Identifier uint32
+	Err        error
+	// Sending the notification had to connect first, so its latency
+	// includes the connect and TLS handshake.
+	Reconnected bool
+}
+
+// Send a notification to iOS, returning the full result of sending it.
+func (a *Apn) SendWithResult(notification *Notification) SendResult {
+	if notification == nil {
+		return SendResult{Err: ErrNilNotification}
+	}
+	if a.coalesceWindow > 0 {
+		if isBadgeOnly(notification) {
+			a.coalesceBadge(notification)
+			return SendResult{Token: notification.DeviceToken}
+		}
+		a.flushBadge(notification.DeviceToken)
+	}
+	return a.submit(context.Background(), notification)
+}
+
+// Send a copy of notification to each of tokens. The result for each token
+// is at its index, with ErrNilNotification for every token if notification
+// is nil.
+func (a *Apn) SendMulti(notification *Notification, tokens []string) []SendResult {
+	results := make([]SendResult, len(tokens))
+	for i, token := range tokens {
+		if notification == nil {
+			results[i] = SendResult{Token: token, Err: ErrNilNotification}
+			continue
+		}
+		n := *notification
+		n.DeviceToken = token
+		results[i] = a.SendWithResult(&n)
+	}
+	return results
+}
+
+// Send notifications in order until ctx is done. The result of each
+// notification is at its index: nil if sent, or its error. The ones not
+// sent because ctx was done get ctx.Err(), and the ones not sent because an
+// earlier one failed (see WithBatchPolicy) get ErrNotAttempted. Apple
+// reports the ones it rejects on ErrorChan later.
+func (a *Apn) SendBatch(ctx context.Context, notifications []*Notification) []error {
+	errs := make([]error, len(notifications))
+	failed := false
+	for i, notification := range notifications {
+		if err := ctx.Err(); err != nil {
+			errs[i] = err
+			continue
+		}
+		if failed && a.batchPolicy == StopOnSendError {
+			errs[i] = ErrNotAttempted
+			continue
+		}
+		errs[i] = a.submit(ctx, notification).Err
+		failed = failed || errs[i] != nil
+	}
+	return errs
+}
+
+// Send notification and wait until ctx is done for Apple to reject it,
+// returning the error response if it does and nil otherwise. Apple only
+// answers failures, so nil means none arrived in time, not that the
+// notification was delivered; give ctx a deadline. A notification Apple
+// drops after another one failed is resent with a new identifier, and
+// SendAndWait doesn't follow it there.
+func (a *Apn) SendAndWait(ctx context.Context, notification *Notification) (uint32, error) {
+	watch := make(chan NotificationError, 4)
+	a.watchLock.Lock()
+	if a.watchers == nil {
+		a.watchers = make(map[chan NotificationError]bool)
+	}
+	a.watchers[watch] = true
+	a.watchLock.Unlock()
+	defer func() {
+		a.watchLock.Lock()
+		delete(a.watchers, watch)
+		a.watchLock.Unlock()
+	}()
+
+	r := a.submit(ctx, notification)
+	if r.Err != nil {
+		return r.Identifier, r.Err
+	}
+	for {
+		select {
+		case e := <-watch:
+			if e.Identifier != r.Identifier {
+				break
+			}
+			if e.Status == statusShutdown {
+				// Apple delivered it before shutting down
+				return r.Identifier, nil
+			}
+			return r.Identifier, e
+		case <-ctx.Done():
+			return r.Identifier, nil
+		}
+	}
+}
+
+// Device token SelfTest sends to, which Apple rejects as invalid.
+var selfTestToken = strings.Repeat("00", 32)
+
+// Check the certificate and the connection to Apple work by sending a
+// notification to an invalid token and waiting for Apple to reject it as such:
+// a nil error means Apple read it. A connection or certificate failure is
+// returned as it is, and ErrSelfTestUnconfirmed if Apple didn't reply before
+// ctx was done, so ctx needs a deadline. The rejection also goes to
+// ErrorChan like any other, a Service passes the token to onInvalidToken.
+func (a *Apn) SelfTest(ctx context.Context) error {
+	_, err := a.SendAndWait(ctx, &Notification{DeviceToken: selfTestToken, Payload: &Payload{Aps: Aps{AlertString: "self test"}}})
+	if err == nil {
+		return ErrSelfTestUnconfirmed
+	}
+	var e NotificationError
+	if errors.As(err, &e) && e.OtherError == nil && e.Command == 8 && e.Status == statusInvalidToken {
+		return nil
+	}
+	return err
+}
+
+// Pass Apple's error response e to every SendAndWait, without waiting for
+// ones that are busy.
+func (a *Apn) notifyWatchers(e NotificationError) {
+	a.watchLock.Lock()
+	defer a.watchLock.Unlock()
+	for watch := range a.watchers {
+		select {
+		case watch <- e:
+		default:
+		}
+	}
+}
+
+// Send each notification read from in and write its result to results, until
+// in is closed or ctx is done. Notifications go out on the same connection,
+// like with Send.
+func (a *Apn) SendStream(ctx context.Context, in <-chan *Notification, results chan<- SendResult) {
+	for {
+		var notification *Notification
+		select {
+		case n, ok := <-in:
+			if !ok {
+				return
+			}
+			notification = n
+		case <-ctx.Done():
+			return
+		}
+		r := a.submit(ctx, notification)
+		select {
+		case results <- r:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Hand notification to sendLoop and wait for the result, unless ctx is
+// done or Apn closed before sendLoop takes it.
+func (a *Apn) submit(ctx context.Context, notification *Notification) SendResult {
+	if notification == nil {
+		return SendResult{Err: ErrNilNotification}
+	}
+	if err := a.runValidators(notification); err != nil {
+		return SendResult{Token: notification.DeviceToken, Err: err}
+	}
+	if a.tokenLimiter != nil {
+		if err := a.tokenLimiter.allow(ctx, notification.DeviceToken); err != nil {
+			return SendResult{Token: notification.DeviceToken, Err: err}
+		}
+	}
+	r := a.enqueue(ctx, &sendArg{n: notification})
+	r.Token = notification.DeviceToken
+	return r
+}
+
+// Add a validator every notification sent must pass, e.g. to enforce a
+// policy on tokens or custom keys. Validators run in the order they were
+// added, before the notification is queued, and the first error one returns
+// is the send's error. Safe to call while sending.
+func (a *Apn) AddValidator(validate func(n *Notification) error) {
+	a.validatorLock.Lock()
+	a.validators = append(a.validators[:len(a.validators):len(a.validators)], validate)
+	a.validatorLock.Unlock()
+}
+
+func (a *Apn) currentValidators() []func(n *Notification) error {
+	a.validatorLock.Lock()
+	defer a.validatorLock.Unlock()
+	return a.validators
+}
+
+// Run the AddValidator validators on n, stopping at the first error.
+func (a *Apn) runValidators(n *Notification) error {
+	for _, validate := range a.currentValidators() {
+		if err := validate(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Hand arg to sendLoop and wait for the result, like submit.
+func (a *Apn) enqueue(ctx context.Context, arg *sendArg) SendResult {
+	r := SendResult{}
+	select {
+	case <-a.done:
+		r.Err = ErrClosed
+		return r
+	default:
+	}
 	err := make(chan error)
-	arg := &sendArg{
-		n:   notification,
-		err: err,
+	arg.err = err
+	arg.enqueued = time.Now()
+	atomic.AddInt32(&a.queued, 1)
+	select {
+	case a.sendChan <- arg:
+		atomic.AddInt32(&a.queued, -1)
+	case <-a.done:
+		atomic.AddInt32(&a.queued, -1)
+		if arg.n != nil && atomic.LoadInt32(&a.aborted) != 0 {
+			a.dropped(arg.n, ErrAborted)
+		}
+		r.Err = ErrClosed
+		return r
+	case <-ctx.Done():
+		atomic.AddInt32(&a.queued, -1)
+		r.Err = ctx.Err()
+		return r
+	}
+	r.Err = <-err
+	r.Identifier, r.Reconnected = arg.identifier, arg.reconnected
+	return r
+}
+
+// Run f on a goroutine counted by ActiveWorkers, a Broadcast sibling's by
+// its parent's too.
+func (a *Apn) spawn(f func()) {
+	a.addWorkers(1)
+	go func() {
+		defer a.addWorkers(-1)
+		f()
+	}()
+}
+
+func (a *Apn) addWorkers(n int32) {
+	for ; a != nil; a = a.parent {
+		atomic.AddInt32(&a.workers, n)
 	}
-	a.sendChan <- arg
-	return <-err
 }
 
+// Number of goroutines Apn runs right now: the sending goroutine until
+// Close, one reading Apple's error responses per open connection, plus the
+// Ping dials, badge coalescing flushes and Broadcasts in progress, with
+// the goroutines of their extra connections. Sends run on their caller's
+// goroutine, so load doesn't add any.
+func (a *Apn) ActiveWorkers() int {
+	return int(atomic.LoadInt32(&a.workers))
+}
+
+// Number of notifications waiting for the sender to pick them up.
+func (a *Apn) QueueDepth() int {
+	return int(atomic.LoadInt32(&a.queued))
+}
+
+// When a notification was last written to the connection, or the zero Time
+// if none was yet. Apple doesn't confirm notifications, so this is the last
+// successful write, not the last delivery.
+func (a *Apn) LastSuccessfulSend() time.Time {
+	t := atomic.LoadInt64(&a.lastSend)
+	if t == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, t)
+}
+
+// Number of notifications sent on the current connection, 0 without one.
+func (a *Apn) ConnectionSends() int {
+	return int(atomic.LoadInt32(&a.connSends))
+}
+
+// Report whether the connection sent as many notifications as
+// WithMaxSendsPerConnection allows and should be replaced.
+func (a *Apn) cycleDue() bool {
+	return a.maxSendsPerConn > 0 && a.ConnectionSends() >= a.maxSendsPerConn
+}
+
+// Number of notifications written to the current connection. Apple only
+// reports failures, so these are kept until the connection closes in case
+// they must be resent.
+func (a *Apn) InFlight() int {
+	a.inflightLock.Lock()
+	defer a.inflightLock.Unlock()
+	return len(a.inflight)
+}
+
+// The identifier the next notification sent gets. Identifiers go on across
+// reconnects; a dry run uses them up too.
+func (a *Apn) CurrentIdentifier() uint32 {
+	return atomic.LoadUint32(&a.identifier)
+}
+
+// A notification in flight, see InFlightSnapshot.
+type InFlightEntry struct {
+	Identifier uint32
+	Token      string
+	// When it was handed to Send.
+	Enqueued time.Time
+}
+
+// Copy of the notifications in flight on the current connection, oldest
+// first, e.g. to log when sending seems stuck. The tokens are redacted like
+// WithTokenRedaction says.
+func (a *Apn) InFlightSnapshot() []InFlightEntry {
+	a.inflightLock.Lock()
+	defer a.inflightLock.Unlock()
+	entries := make([]InFlightEntry, len(a.inflight))
+	for i, f := range a.inflight {
+		entries[i] = InFlightEntry{f.identifier, redactToken(f.notification.DeviceToken, a.tokenShown), f.enqueued}
+	}
+	return entries
+}
+
+// Send closes and reopens the connection instead of sending n when reconnect
+// is set.
 type sendArg struct {
-	n   *Notification
-	err chan<- error
+	n           *Notification
+	reconnect   bool
+	err         chan<- error
+	identifier  uint32
+	reconnected bool
+	enqueued    time.Time
+}
+
+// Close the current connection and establish a fresh one, e.g. after
+// rotating certificates. Sends already handed to Apn finish on the old
+// connection; later ones go out on the new one. If Apple reported an error
+// on the old connection by the time it's closed, the notifications it
+// dropped after the failed one are resent on the new one, like after any
+// error. Errors Apple reports for notifications sent on the old connection
+// afterwards are dropped, and what it dropped after them is lost: Apple
+// never confirms notifications, so there's no telling which those are.
+func (a *Apn) Reconnect() error {
+	return a.enqueue(context.Background(), &sendArg{reconnect: true}).Err
+}
+
+// Close the current connection and connect to server instead, e.g. to move
+// to another gateway without making a new Apn. Like with Reconnect, sends
+// already handed to Apn finish on the old connection and later ones go to
+// server. Notifications already written to the old connection aren't sent
+// again, Apple may well have delivered them, unless it dropped them after an
+// error it reported, see Reconnect. If connecting to server fails, Apn goes back to
+// the old server, connecting to it again on the next send. The name the
+// server's certificate is verified against moves to server's host too,
+// unless it was set with WithServerName.
+func (a *Apn) SwitchServer(server string) error {
+	a.confLock.Lock()
+	old, oldConf := a.server, a.conf
+	a.server = server
+	if host, _, err := net.SplitHostPort(server); err == nil && a.derivedName {
+		conf := a.conf.Clone()
+		conf.ServerName = host
+		a.conf = conf
+	}
+	a.confLock.Unlock()
+	err := a.Reconnect()
+	if err != nil {
+		a.confLock.Lock()
+		a.server, a.conf = old, oldConf
+		a.confLock.Unlock()
+	}
+	return err
+}
+
+// The address of the server to connect to.
+func (a *Apn) serverAddr() string {
+	a.confLock.Lock()
+	defer a.confLock.Unlock()
+	return a.server
 }
 
+// Send arg's notification and report the result, reporting whether writing
+// it to the connection failed, which leaves the connection unusable.
+func (a *Apn) deliver(arg *sendArg) bool {
+	if atomic.LoadInt32(&a.aborted) != 0 {
+		a.dropped(arg.n, ErrAborted)
+		a.reply(arg, ErrClosed)
+		return true
+	}
+	enqueued := arg.enqueued
+	if enqueued.IsZero() {
+		// a resend, or a notification replayed on reconnecting
+		enqueued = time.Now()
+	}
+	identifier, err := a.sendEnqueued(arg.n, enqueued)
+	arg.identifier = identifier
+	if a.events != nil {
+		fields := map[string]interface{}{"token": redactToken(arg.n.DeviceToken, a.tokenShown), "identifier": identifier}
+		if !arg.enqueued.IsZero() {
+			fields["latency_ms"] = milliseconds(time.Since(arg.enqueued))
+		}
+		level := "debug"
+		if err != nil {
+			level = "error"
+			fields["error"] = err.Error()
+		}
+		a.logEvent(level, "send", fields)
+	}
+	a.reply(arg, err)
+	var c *connectionError
+	return errors.As(err, &c)
+}
+
+// Report the result of sending arg. A resent notification has nobody waiting
+// on it, so its failure goes to ErrorChan instead, with the identifier it was
+// sent with.
+func (a *Apn) reply(arg *sendArg, err error) {
+	if err != nil {
+		a.setLastError(err)
+		if !arg.reconnect {
+			a.count(func(s *Stats) { s.Failed++ })
+		}
+	}
+	if arg.err != nil {
+		arg.err <- err
+		return
+	}
+	if err != nil {
+		e := NewNotificationError(nil, err)
+		e.Identifier = arg.identifier
+		e.generation = atomic.LoadUint32(&a.generation)
+		e.notification = arg.n
+		e.tokenShown = a.tokenShown
+		a.reportError(e)
+	}
+}
+
+// Close the connection and stop sending. Send returns ErrClosed afterwards.
 func (a *Apn) Close() error {
-	if a.conn == nil {
+	a.closeOnce.Do(func() {
+		close(a.done)
+	})
+	// nobody should wait for errors from the connection any more
+	atomic.AddUint32(&a.generation, 1)
+	return a.closeConn()
+}
+
+// How long each of Shutdown's waits takes at most without WithDrainTimeout.
+const defaultDrainTimeout = 5 * time.Second
+
+// Close gracefully: wait for the queued sends to be sent, Flush, give Apple
+// the time to report an error on what was sent, then Close. Each of the two
+// waits lasts at most the WithDrainTimeout timeout, and ctx can cut either
+// short. The second one ends early when Apple closes the connection after
+// an error; what Apple dropped after it isn't resent. Returns
+// ErrDrainTimeout if the queued sends weren't sent in time, or ctx's error.
+func (a *Apn) Shutdown(ctx context.Context) error {
+	defer a.Close()
+	timeout := a.drainTimeout
+	if timeout <= 0 {
+		timeout = defaultDrainTimeout
+	}
+	wait := func(done func() bool) error {
+		deadline := time.After(timeout)
+		tick := time.NewTicker(10 * time.Millisecond)
+		defer tick.Stop()
+		for !done() {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-deadline:
+				return ErrDrainTimeout
+			case <-tick.C:
+			}
+		}
 		return nil
 	}
+
+	if err := wait(func() bool { return a.QueueDepth() == 0 }); err != nil {
+		return err
+	}
+	if err := a.Flush(ctx); err != nil {
+		return err
+	}
+	err := wait(func() bool {
+		a.connLock.Lock()
+		defer a.connLock.Unlock()
+		return a.conn == nil
+	})
+	if err == ErrDrainTimeout {
+		// Apple reported no error in time
+		return nil
+	}
+	return err
+}
+
+// Stop sending right away, for an emergency stop: unlike Close, nothing
+// buffered is flushed, and the notifications queued or waiting to be resent
+// are dropped, see WithOnDropped, with ErrAborted. Their sends return
+// ErrClosed, like every send afterwards.
+func (a *Apn) Abort() error {
+	atomic.StoreInt32(&a.aborted, 1)
+	a.writeLock.Lock()
+	a.writer = nil
+	a.writeLock.Unlock()
+	return a.Close()
+}
+
+// Drop the notifications waiting to be resent, if Abort stopped sending.
+func (a *Apn) abandon() {
+	if atomic.LoadInt32(&a.aborted) == 0 {
+		return
+	}
+	for _, n := range a.resend {
+		a.dropped(n, ErrAborted)
+	}
+	a.resend = nil
+}
+
+func (a *Apn) closeConn() error {
+	a.connLock.Lock()
 	conn := a.conn
 	a.conn = nil
-	return conn.Close()
+	a.connLock.Unlock()
+	atomic.StoreInt32(&a.connSends, 0)
+	if conn == nil {
+		return nil
+	}
+	var flushErr error
+	a.setWriteDeadline(conn)
+	a.writeLock.Lock()
+	if a.writer != nil {
+		flushErr = a.writer.Flush()
+		a.writer = nil
+	}
+	a.writeLock.Unlock()
+	err := conn.Close()
+	if flushErr != nil {
+		// the buffered notifications are lost, their sends returned nil
+		return fmt.Errorf("flush socket error: %s", flushErr)
+	}
+	return err
 }
 
-func (a *Apn) connect() (<-chan int, error) {
-	// make sure last readError(...) will fail when reading.
-	err := a.Close()
+// The certificate chain the server presented on the current connection, or
+// nil when not connected. Use ConnectionState to tell the two apart.
+func (a *Apn) PeerCertificates() []*x509.Certificate {
+	state, err := a.ConnectionState()
 	if err != nil {
-		return nil, fmt.Errorf("close last connection failed: %s", err)
+		return nil
+	}
+	return state.PeerCertificates
+}
+
+// The TLS state of the current connection, or ErrNotConnected when there is
+// none, e.g. before the first send or after idling for the timeout.
+func (a *Apn) ConnectionState() (tls.ConnectionState, error) {
+	a.connLock.Lock()
+	defer a.connLock.Unlock()
+	if a.conn == nil {
+		return tls.ConnectionState{}, ErrNotConnected
+	}
+	return a.conn.ConnectionState(), nil
+}
+
+// Check the server can be reached and accepts the certificate by connecting
+// on a throwaway connection and closing it, without sending anything. The
+// connection used for sending isn't touched.
+func (a *Apn) Ping(ctx context.Context) error {
+	result := make(chan error, 1)
+	a.spawn(func() {
+		conn, err := a.dialTLS()
+		if err == nil {
+			conn.Close()
+		}
+		result <- err
+	})
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
+
+func (a *Apn) connect() (<-chan *NotificationError, error) {
+	if a.dryRun {
+		return nil, nil
+	}
+
+	// bump the generation first, so anything the last readError(...) reports
+	// after the close below is dropped as stale.
+	generation := atomic.AddUint32(&a.generation, 1)
 
-	conn, err := net.Dial("tcp", a.server)
+	// make sure last readError(...) will fail when reading.
+	err := a.closeConn()
 	if err != nil {
-		return nil, fmt.Errorf("connect to server error: %d", err)
+		return nil, fmt.Errorf("close last connection failed: %s", err)
 	}
 
-	var client_conn *tls.Conn = tls.Client(conn, a.conf)
-	err = client_conn.Handshake()
+	dialed := time.Now()
+	client_conn, err := a.dialTLS()
 	if err != nil {
-		return nil, fmt.Errorf("handshake server error: %s", err)
+		a.logEvent("error", "connect", map[string]interface{}{"server": a.serverAddr(), "error": err.Error()})
+		return nil, err
+	}
+	event := "connect"
+	if a.hasConnected {
+		event = "reconnect"
+	}
+	a.logEvent("info", event, map[string]interface{}{"server": a.serverAddr(), "latency_ms": milliseconds(time.Since(dialed))})
+	if a.logger != nil {
+		server := a.serverAddr()
+		a.logf("connected to %s (%s, topic %s)", server, environment(server), a.topic())
+	}
+	if a.onConnect != nil {
+		a.onConnect(client_conn.ConnectionState())
 	}
+	a.count(func(s *Stats) { s.Reconnects++ })
+	a.setLastError(nil)
 
+	a.inflightLock.Lock()
+	a.inflight = nil
+	a.inflightLock.Unlock()
+
+	a.connLock.Lock()
 	a.conn = client_conn
-	quit := make(chan int)
-	go readError(client_conn, quit, a.errorChan)
+	a.connLock.Unlock()
+	if a.writeBufferSize > 0 {
+		a.writeLock.Lock()
+		a.writer = bufio.NewWriterSize(client_conn, a.writeBufferSize)
+		a.writeLock.Unlock()
+	}
+	quit := make(chan *NotificationError, 1)
+	a.spawn(func() { readError(a, client_conn, generation, quit) })
 
+	if a.hasConnected && a.onReconnect != nil {
+		for _, n := range a.onReconnect() {
+			if n != nil && a.deliver(&sendArg{n: n}) {
+				break
+			}
+		}
+	}
+	a.hasConnected = true
 	return quit, nil
 }
 
+// The topic of the certificate, or "unknown", for logging.
+func (a *Apn) topic() string {
+	a.confLock.Lock()
+	certificate := a.conf.Certificates[0]
+	a.confLock.Unlock()
+	leaf := certificate.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(certificate.Certificate[0]); err != nil {
+			return "unknown"
+		}
+	}
+	if topic := certTopic(leaf); topic != "" {
+		return topic
+	}
+	return "unknown"
+}
+
+// The dialer connecting to the server without WithDialFunc.
+func (a *Apn) dialer() *net.Dialer {
+	return &net.Dialer{Timeout: a.dialTimeout, KeepAlive: a.idlePing, LocalAddr: a.localAddr}
+}
+
+// The network to dial, see WithNetwork.
+func (a *Apn) dialNetwork() string {
+	if a.network == "" {
+		return "tcp"
+	}
+	return a.network
+}
+
+// Dial the server and do the TLS handshake, both within the dial timeout,
+// or the handshake within the handshake timeout if there's one.
+func (a *Apn) dialTLS() (*tls.Conn, error) {
+	a.confLock.Lock()
+	conf := a.conf
+	server := a.server
+	a.confLock.Unlock()
+
+	if a.dial == nil && a.tlsTimeout == 0 {
+		conn, err := tls.DialWithDialer(a.dialer(), a.dialNetwork(), server, conf)
+		if err != nil {
+			a.logf("connect to %s failed: %s", server, err)
+			return nil, &connectionError{fmt.Errorf("connect to server error: %w", err)}
+		}
+		a.setNoDelay(conn.NetConn())
+		return conn, nil
+	}
+
+	dial := a.dial
+	if dial == nil {
+		dial = a.dialer().Dial
+	}
+	conn, err := dial(a.dialNetwork(), server)
+	if err != nil {
+		a.logf("connect to %s failed: %s", server, err)
+		return nil, &connectionError{fmt.Errorf("connect to server error: %w", err)}
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok && a.idlePing > 0 {
+		tcp.SetKeepAlive(true)
+		tcp.SetKeepAlivePeriod(a.idlePing)
+	}
+	a.setNoDelay(conn)
+	if a.tlsTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(a.tlsTimeout))
+	} else if a.dialTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(a.dialTimeout))
+	}
+	client_conn := tls.Client(conn, conf)
+	err = client_conn.Handshake()
+	if err != nil {
+		conn.Close()
+		a.logf("handshake with %s failed: %s", server, err)
+		var timeout net.Error
+		if a.tlsTimeout > 0 && errors.As(err, &timeout) && timeout.Timeout() {
+			err = fmt.Errorf("%w after %s: %s", ErrHandshakeTimeout, a.tlsTimeout, err)
+		}
+		return nil, &connectionError{fmt.Errorf("handshake server error: %w", err)}
+	}
+	conn.SetDeadline(time.Time{})
+	return client_conn, nil
+}
+
+// Apply WithNoDelay to conn, if it's a TCP connection.
+func (a *Apn) setNoDelay(conn net.Conn) {
+	if tcp, ok := conn.(interface{ SetNoDelay(bool) error }); ok {
+		tcp.SetNoDelay(!a.nagle)
+	}
+}
+
 const maxPayloadBytes = 256
 
-func (a *Apn) send(notification *Notification) error {
-	tokenbin, err := hex.DecodeString(notification.DeviceToken)
+// Binary protocol commands a notification can be sent with.
+const (
+	CommandEnhanced uint8 = 1
+	CommandFramed   uint8 = 2
+)
+
+const tokenBytes = 32
+
+// Check notification can be sent before sending it, e.g. to validate a batch
+// up front. Returns the first problem found, which is the same error sending
+// it would return. The payload is checked against the default limit of 256
+// bytes, see WithMaxPayloadBytes.
+func (n *Notification) Validate() error {
+	_, _, err := n.validate(maxPayloadBytes)
+	return err
+}
+
+// Write the frame an Apn in the default enhanced format sends n in, with
+// identifier, to w, e.g. to archive sent notifications. An
+// ExpireAfterSeconds expiry counts from now, so set ExpiryUnix for the same
+// bytes as the send. Fails like Validate if n can't be sent.
+func (n *Notification) WriteTo(w io.Writer, identifier uint32) (int64, error) {
+	token, payload, err := n.validate(maxPayloadBytes)
 	if err != nil {
-		return fmt.Errorf("convert token to hex error: %s", err)
+		return 0, err
 	}
+	written, err := w.Write(encodeEnhanced(identifier, n.expiry(time.Now()), token, payload))
+	return int64(written), err
+}
 
-	payloadbyte, err := notification.Payload.MarshalJSON()
+// Validate the notification against a payload limit, returning its decoded
+// token and marshaled payload.
+func (n *Notification) validate(limit int) (token, payload []byte, err error) {
+	if strings.TrimSpace(n.DeviceToken) == "" {
+		return nil, nil, ErrEmptyDeviceToken
+	}
+	token, err = DecodeToken(n.DeviceToken)
+	if err == ErrInvalidTokenSize {
+		return nil, nil, err
+	}
 	if err != nil {
-		return fmt.Errorf("convert payload to json: %s", err)
+		return nil, nil, fmt.Errorf("convert token to hex error: %s", err)
 	}
-	if len(payloadbyte) > maxPayloadBytes {
-		return fmt.Errorf("payload json too large: %s", string(payloadbyte))
+	if n.Priority != 0 && n.Priority != 5 && n.Priority != 10 {
+		return nil, nil, ErrInvalidPriority
 	}
 
-	expiry := time.Now().Add(time.Duration(notification.ExpireAfterSeconds) * time.Second).Unix()
+	if n.sent != nil {
+		payload = n.sent
+	} else if n.RawPayload != nil {
+		payload = n.RawPayload
+	} else if n.Payload == nil {
+		return nil, nil, ErrMissingPayload
+	} else if n.Payload.empty() {
+		return nil, nil, ErrEmptyAlertPayload
+	} else if payload, err = n.Payload.MarshalJSON(); err != nil {
+		return nil, nil, &MarshalError{err}
+	}
+	if len(payload) > limit {
+		var aps []byte
+		if n.RawPayload != nil {
+			var raw map[string]json.RawMessage
+			json.Unmarshal(payload, &raw)
+			aps = raw["aps"]
+		} else {
+			aps, _ = json.Marshal(n.Payload.Aps)
+		}
+		return nil, nil, &PayloadTooLargeError{
+			Payload:     payload,
+			Limit:       limit,
+			ApsBytes:    len(aps),
+			CustomBytes: len(payload) - len(aps),
+		}
+	}
+	if n.RawPayload != nil && (!json.Valid(payload) || bytes.TrimLeft(payload, " \t\r\n")[0] != '{') {
+		return nil, nil, ErrInvalidRawPayload
+	}
+	return token, payload, nil
+}
 
-	buffer := bytes.NewBuffer([]byte{})
-	binary.Write(buffer, binary.BigEndian, uint8(1))
-	binary.Write(buffer, binary.BigEndian, a.identifier)
-	binary.Write(buffer, binary.BigEndian, uint32(expiry))
-	binary.Write(buffer, binary.BigEndian, uint16(len(tokenbin)))
-	binary.Write(buffer, binary.BigEndian, tokenbin)
-	binary.Write(buffer, binary.BigEndian, uint16(len(payloadbyte)))
-	binary.Write(buffer, binary.BigEndian, payloadbyte)
-	pushPackage := buffer.Bytes()
+// Validate a copy of n with its alert body truncated to fit limit, see
+// WithTruncateBody, or return err if it can't fit.
+func (n *Notification) truncated(limit int, err error) ([]byte, []byte, error) {
+	p := *n.Payload
+	if d := p.Aps.AlertDictionary; d != nil {
+		copied := *d
+		p.Aps.AlertDictionary = &copied
+	}
+	if !p.TruncateBody(limit) {
+		return nil, nil, err
+	}
+	c := *n
+	c.Payload = &p
+	return c.validate(limit)
+}
 
-	a.identifier += 1
-	_, err = a.conn.Write(pushPackage)
+// Write notification to the connection, returning the identifier it got.
+func (a *Apn) send(notification *Notification) (uint32, error) {
+	return a.sendEnqueued(notification, time.Now())
+}
+
+// Like send, for a notification handed to Send at enqueued.
+func (a *Apn) sendEnqueued(notification *Notification, enqueued time.Time) (uint32, error) {
+	if a.tokenFilter != nil && !a.tokenFilter(notification.DeviceToken) {
+		a.dropped(notification, ErrTokenFiltered)
+		return 0, ErrTokenFiltered
+	}
+	tokenbin, payloadbyte, err := notification.validate(a.maxPayloadBytes)
+	var tooLarge *PayloadTooLargeError
+	if a.truncateBody && errors.As(err, &tooLarge) && notification.RawPayload == nil && notification.sent == nil {
+		tokenbin, payloadbyte, err = notification.truncated(a.maxPayloadBytes, err)
+	}
 	if err != nil {
-		return fmt.Errorf("write socket error: %s", err)
+		return 0, err
+	}
+	if a.strictKeys && notification.RawPayload == nil {
+		if err := notification.Payload.CheckCustomKeys(); err != nil {
+			return 0, err
+		}
+	}
+	if a.strictRaw && notification.RawPayload != nil {
+		var raw map[string]json.RawMessage
+		json.Unmarshal(payloadbyte, &raw)
+		if _, ok := raw["aps"]; !ok {
+			return 0, ErrMissingAps
+		}
+	}
+	if a.payloadWarnAt > 0 && len(payloadbyte) > a.payloadWarnAt {
+		a.logf("payload of %d bytes is close to the %d byte limit: %s", len(payloadbyte), a.maxPayloadBytes, payloadbyte)
+	}
+	if notification.isHybrid() {
+		a.logf("payload is content-available but alerts, sending it as an alert: %s", payloadbyte)
+	}
+
+	expiry := notification.expiry(time.Now())
+	if a.bgExpiry > 0 && notification.isBackground() && notification.ExpiryUnix == 0 && notification.ExpireAfterSeconds == 0 {
+		expiry = uint32(time.Now().Add(a.bgExpiry).Unix())
+	}
+
+	var pushPackage []byte
+	if a.command == CommandFramed {
+		pushPackage = encodeFramed(a.identifier, expiry, tokenbin, payloadbyte, notification.Priority)
+	} else {
+		pushPackage = encodeEnhanced(a.identifier, expiry, tokenbin, payloadbyte)
+	}
+
+	if a.maxInFlight > 0 && a.InFlight() >= a.maxInFlight {
+		a.dropped(notification, ErrInFlightFull)
+		return 0, ErrInFlightFull
+	}
+
+	identifier := a.identifier
+	atomic.AddUint32(&a.identifier, 1)
+	if a.dryRun {
+		return identifier, nil
+	}
+
+	_, err = a.write(pushPackage)
+	if err != nil {
+		return identifier, &connectionError{fmt.Errorf("write socket error: %w", err)}
+	}
+
+	a.inflightLock.Lock()
+	a.inflight = append(a.inflight, inFlight{identifier, notification, expiry, enqueued, payloadbyte})
+	a.inflightLock.Unlock()
+	atomic.StoreInt64(&a.lastSend, time.Now().UnixNano())
+	atomic.AddInt32(&a.connSends, 1)
+	a.count(func(s *Stats) {
+		s.Sent++
+		s.Bytes += uint64(len(pushPackage))
+	})
+	return identifier, nil
+}
+
+// Write p to the connection, or to the write buffer if there is one.
+func (a *Apn) write(p []byte) (int, error) {
+	a.connLock.Lock()
+	conn := a.conn
+	a.connLock.Unlock()
+	a.setWriteDeadline(conn)
+
+	a.writeLock.Lock()
+	if w := a.writer; w != nil {
+		if w.Buffered() == 0 {
+			a.flushAt = time.Now().Add(a.flushInterval)
+		}
+		defer a.writeLock.Unlock()
+		return w.Write(p)
+	}
+	a.writeLock.Unlock()
+
+	if conn == nil {
+		// Close ran from another goroutine while sending
+		select {
+		case <-a.done:
+			return 0, ErrClosed
+		default:
+			return 0, ErrNotConnected
+		}
+	}
+	return writeFull(conn, p)
+}
+
+// Give the next write to conn the WithWriteTimeout timeout, if there's one.
+func (a *Apn) setWriteDeadline(conn *tls.Conn) {
+	if conn != nil && a.writeTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(a.writeTimeout))
+	}
+}
+
+// Write all of p to w, going on after short writes, so a frame is never cut
+// off. A write making no progress without an error fails with
+// io.ErrShortWrite.
+func writeFull(w io.Writer, p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		n, err := w.Write(p[written:])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			return written, io.ErrShortWrite
+		}
+	}
+	return written, nil
+}
+
+// Fire when buffered frames are due to be flushed; never fire if there are none.
+func (a *Apn) flushDue() <-chan time.Time {
+	a.writeLock.Lock()
+	defer a.writeLock.Unlock()
+	if a.writer == nil || a.writer.Buffered() == 0 {
+		return nil
+	}
+	return time.After(time.Until(a.flushAt))
+}
+
+// Flush buffered frames to the connection.
+func (a *Apn) flush() error {
+	a.connLock.Lock()
+	a.setWriteDeadline(a.conn)
+	a.connLock.Unlock()
+	a.writeLock.Lock()
+	defer a.writeLock.Unlock()
+	if a.writer == nil {
+		return nil
+	}
+	return a.writer.Flush()
+}
+
+// Report whether n is a content-available background push. One that also
+// shows an alert or plays a sound is an alert push, not a background one;
+// one that also sets the badge is still a background push.
+func (n *Notification) isBackground() bool {
+	return n.RawPayload == nil && n.Payload != nil && n.Payload.Aps.ContentAvailable && !n.Payload.alerts()
+}
+
+// Report whether n is both content-available and alerting, which Apple
+// delivers as an alert.
+func (n *Notification) isHybrid() bool {
+	return n.RawPayload == nil && n.Payload != nil && n.Payload.Aps.ContentAvailable && n.Payload.alerts()
+}
+
+// The expiry written into the frame for a notification sent at now.
+func (n *Notification) expiry(now time.Time) uint32 {
+	if n.ExpiryUnix != 0 {
+		return uint32(n.ExpiryUnix)
+	}
+	return uint32(now.Add(time.Duration(n.ExpireAfterSeconds) * time.Second).Unix())
+}
+
+// Encode a notification in the enhanced format, CommandEnhanced.
+func encodeEnhanced(identifier, expiry uint32, token, payload []byte) []byte {
+	buffer := bytes.NewBuffer([]byte{})
+	binary.Write(buffer, binary.BigEndian, CommandEnhanced)
+	binary.Write(buffer, binary.BigEndian, identifier)
+	binary.Write(buffer, binary.BigEndian, expiry)
+	binary.Write(buffer, binary.BigEndian, uint16(len(token)))
+	binary.Write(buffer, binary.BigEndian, token)
+	binary.Write(buffer, binary.BigEndian, uint16(len(payload)))
+	binary.Write(buffer, binary.BigEndian, payload)
+	return buffer.Bytes()
+}
+
+// Encode a notification in the framed format, CommandFramed: a frame of items,
+// each an id, a length and data. A priority of 0 leaves the priority item out,
+// which Apple treats as 10.
+func encodeFramed(identifier, expiry uint32, token, payload []byte, priority uint8) []byte {
+	items := bytes.NewBuffer([]byte{})
+	item := func(id uint8, data interface{}) {
+		binary.Write(items, binary.BigEndian, id)
+		binary.Write(items, binary.BigEndian, uint16(binary.Size(data)))
+		binary.Write(items, binary.BigEndian, data)
+	}
+	item(1, token)
+	item(2, payload)
+	item(3, identifier)
+	item(4, expiry)
+	if priority != 0 {
+		item(5, priority)
+	}
+
+	buffer := bytes.NewBuffer([]byte{})
+	binary.Write(buffer, binary.BigEndian, CommandFramed)
+	binary.Write(buffer, binary.BigEndian, uint32(items.Len()))
+	buffer.Write(items.Bytes())
+	return buffer.Bytes()
+}
+
+// Look up the notification sent on the current connection with identifier.
+func (a *Apn) lookup(identifier uint32) *Notification {
+	a.inflightLock.Lock()
+	defer a.inflightLock.Unlock()
+	for _, f := range a.inflight {
+		if f.identifier == identifier {
+			return f.notification
+		}
 	}
 	return nil
 }
 
+// Queue everything sent after the notification e failed on for resending,
+// and the notification itself if it's classified Retry and wasn't yet.
+func (a *Apn) requeue(e *NotificationError) {
+	if e == nil {
+		return
+	}
+	var failed *Notification
+	a.inflightLock.Lock()
+	for i, f := range a.inflight {
+		if f.identifier == e.Identifier {
+			if e.Status != statusShutdown && !f.notification.retried && a.classify(*e) == Retry {
+				n := f.resendCopy()
+				n.retried = true
+				a.resend = append(a.resend, n)
+			} else if e.Status != statusShutdown {
+				failed = f.notification
+			}
+			for _, f := range a.inflight[i+1:] {
+				a.resend = append(a.resend, f.resendCopy())
+			}
+			break
+		}
+	}
+	a.inflightLock.Unlock()
+	if failed != nil {
+		a.dropped(failed, *e)
+		a.deadLetter(failed, *e)
+	}
+}
+
+// Hand n to DeadLetterChan, dropping it if the channel is full.
+func (a *Apn) deadLetter(n *Notification, e NotificationError) {
+	if a.deadLetters == nil {
+		return
+	}
+	select {
+	case a.deadLetters <- DeadLetter{Notification: n, Status: e.Status, Reason: e}:
+	default:
+		atomic.AddUint64(&a.droppedErrors, 1)
+	}
+}
+
+// Tell the WithOnDropped callback n won't be delivered.
+func (a *Apn) dropped(n *Notification, reason error) {
+	a.logEvent("warn", "drop", map[string]interface{}{"token": redactToken(n.DeviceToken, a.tokenShown), "error": reason.Error()})
+	if a.onDropped != nil {
+		a.onDropped(n, reason)
+	}
+}
+
+// Copy of the notification to resend, keeping the expiry and payload it was
+// first sent with, so resending doesn't read a payload changed since.
+func (f inFlight) resendCopy() *Notification {
+	n := *f.notification
+	n.ExpiryUnix = int64(f.expiry)
+	n.sent = f.payload
+	return &n
+}
+
+// Fire when the connection has idled for the timeout and the WithIdleGrace
+// grace; never fire if there's no timeout.
+func (a *Apn) idle() <-chan time.Time {
+	timeout := time.Duration(atomic.LoadInt64(&a.timeout))
+	if timeout <= 0 {
+		return nil
+	}
+	return time.After(timeout + a.idleGrace)
+}
+
+// Change the idle timeout at runtime, e.g. to extend it ahead of a burst of
+// notifications so the connection isn't closed between them. The new timeout
+// applies from the next send; a timeout of 0 (or less) never idle-closes.
+func (a *Apn) SetIdleTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&a.timeout, int64(timeout))
+}
+
+// Report whether arg waited longer than the WithMaxQueueAge age to be picked
+// up. Resends aren't stale, they were picked up in time once.
+func (a *Apn) stale(arg *sendArg) bool {
+	return a.maxQueueAge > 0 && !arg.reconnect && !arg.enqueued.IsZero() && time.Since(arg.enqueued) > a.maxQueueAge
+}
+
+// Next notification to send, resending any dropped by Apple first.
+// Return nil once Apn is closed.
+func (a *Apn) next() *sendArg {
+	if len(a.resend) > 0 {
+		n := a.resend[0]
+		a.resend = a.resend[1:]
+		return &sendArg{n: n}
+	}
+	select {
+	case arg := <-a.sendChan:
+		return arg
+	case <-a.done:
+		return nil
+	}
+}
+
 func sendLoop(apn *Apn) {
+	rewarm := false
 	for {
-		arg := <-apn.sendChan
+		var arg *sendArg
+		if rewarm {
+			// WithWarmConnection: connect again without waiting for a send
+			rewarm = false
+			arg = &sendArg{reconnect: true}
+		} else {
+			arg = apn.next()
+		}
+		if arg == nil {
+			apn.closeConn()
+			apn.abandon()
+			return
+		}
+		if apn.stale(arg) {
+			apn.dropped(arg.n, ErrStale)
+			apn.reply(arg, ErrStale)
+			continue
+		}
 		quit, err := apn.connect()
 		if err != nil {
-			arg.err <- err
+			apn.reply(arg, err)
 			continue
 		}
-		arg.err <- apn.send(arg.n)
+		connected := true
+		if arg.reconnect {
+			apn.reply(arg, nil)
+		} else {
+			arg.reconnected = true
+			connected = !apn.deliver(arg)
+		}
 
-		for connected := true; connected; {
+		for connected && !apn.cycleDue() {
+			if len(apn.resend) > 0 {
+				// dropped by Apple before a Reconnect
+				connected = !apn.deliver(apn.next())
+				continue
+			}
 			select {
-			case <-quit:
+			case e := <-quit:
 				connected = false
-			case <-time.After(apn.timeout):
+				apn.requeue(e)
+			case <-apn.idle():
 				connected = false
+				rewarm = apn.warm
+			case <-apn.flushDue():
+				if err := apn.flush(); err != nil {
+					connected = false
+					e := NewNotificationError(nil, fmt.Errorf("flush socket error: %s", err))
+					e.generation = atomic.LoadUint32(&apn.generation)
+					apn.reportError(e)
+				}
 			case arg := <-apn.sendChan:
-				arg.err <- apn.send(arg.n)
+				if apn.stale(arg) {
+					apn.dropped(arg.n, ErrStale)
+					apn.reply(arg, ErrStale)
+					break
+				}
+				if !arg.reconnect {
+					// a failed write, e.g. a WithWriteTimeout timeout,
+					// reconnects on the next send
+					connected = !apn.deliver(arg)
+					break
+				}
+				if err = apn.drain(quit); err == nil {
+					quit, err = apn.connect()
+				}
+				apn.reply(arg, err)
+				if err != nil {
+					connected = false
+				}
+			case <-apn.done:
+				apn.closeConn()
+				apn.abandon()
+				return
 			}
 		}
 
-		err = apn.Close()
+		// drop what readError reports after the close, like drain does
+		atomic.AddUint32(&apn.generation, 1)
+		err = apn.closeConn()
 		if err != nil {
 			e := NewNotificationError(nil, err)
-			apn.errorChan <- e
+			e.generation = atomic.LoadUint32(&apn.generation)
+			apn.reportError(e)
 		}
 	}
 }
 
-func readError(conn *tls.Conn, quit chan<- int, c chan<- error) {
+// Close the connection quit belongs to, and queue what Apple dropped after
+// an error it reported on it for resending.
+func (a *Apn) drain(quit <-chan *NotificationError) error {
+	// drop what readError reports from here on, like connect does
+	atomic.AddUint32(&a.generation, 1)
+	err := a.closeConn()
+	if err != nil {
+		return fmt.Errorf("close last connection failed: %s", err)
+	}
+	if quit != nil {
+		// a dry run has no connection to wait for
+		a.requeue(<-quit)
+	}
+	return nil
+}
+
+// Apple closing the connection this soon after the handshake, without an
+// error response or anything sent on it, means it refuses the connection.
+const refusedWindow = time.Second
+
+// Read error responses from conn, tagging each with the connection's generation.
+// Errors from a superseded connection are dropped instead of sent to ErrorChan.
+// When conn fails, the last error response read (if any) is sent to quit.
+func readError(apn *Apn, conn net.Conn, generation uint32, quit chan<- *NotificationError) {
+	var last *NotificationError
+	answered := false
+	connected := time.Now()
 	p := make([]byte, 6, 6)
 	for {
 		n, err := conn.Read(p)
+		if n > 0 && apn.onRawRead != nil {
+			apn.onRawRead(append([]byte(nil), p[:n]...))
+		}
+		if err == io.EOF && n == 0 && !answered && time.Since(connected) < refusedWindow && apn.refused(generation) {
+			err = ErrConnectionRefusedByApple
+		}
+		answered = answered || n > 0
 		e := NewNotificationError(p[:n], err)
-		c <- e
+		e.generation = generation
+		if e.OtherError == nil && e.Command == 8 && e.Status == statusNoErrors {
+			// Apple confirming it found no errors isn't a failure.
+			continue
+		}
+		if e.OtherError == nil && e.Command == 8 {
+			e.notification = apn.lookup(e.Identifier)
+			e.tokenShown = apn.tokenShown
+			apn.logEvent("error", "error", map[string]interface{}{"token": e.DeviceToken(), "identifier": e.Identifier, "status": e.Status, "error": e.Error()})
+			apn.countStatus(e.Status)
+			apn.notifyWatchers(e)
+			last = &e
+		}
+		if err == io.EOF && n == 0 && last != nil {
+			// Apple closing after its error response says nothing new.
+		} else if apn.isCurrent(e) {
+			apn.reportError(e)
+		}
 		if err != nil {
-			quit <- 1
+			quit <- last
 			return
 		}
 	}
 }
+
+// Report whether the connection of generation closing can be Apple refusing
+// it: nothing was sent on it, and it wasn't closed here, which bumps the
+// generation.
+func (a *Apn) refused(generation uint32) bool {
+	return atomic.LoadUint32(&a.generation) == generation && a.ConnectionSends() == 0
+}
+
+// Hand e to ErrorChan, following the ErrorChanPolicy when it's full.
+func (a *Apn) reportError(e error) {
+	a.setLastError(e)
+	if a.errorChanPolicy == Block {
+		a.errorChan <- e
+		return
+	}
+	for {
+		select {
+		case a.errorChan <- e:
+			return
+		default:
+		}
+		if a.errorChanPolicy == DropNewest || cap(a.errorChan) == 0 {
+			atomic.AddUint64(&a.droppedErrors, 1)
+			return
+		}
+		select {
+		case <-a.errorChan:
+			atomic.AddUint64(&a.droppedErrors, 1)
+		default:
+		}
+	}
+}
+
+// The most recent error seen since the last successful connect, or nil.
+// This is a snapshot of the last error only, not a history.
+func (a *Apn) LastError() error {
+	a.lastErrorLock.Lock()
+	defer a.lastErrorLock.Unlock()
+	return a.lastError
+}
+
+func (a *Apn) setLastError(err error) {
+	a.lastErrorLock.Lock()
+	a.lastError = err
+	a.lastErrorLock.Unlock()
+}
+
+// Number of errors dropped because ErrorChan, or DeadLetterChan, was full.
+func (a *Apn) DroppedErrors() uint64 {
+	return atomic.LoadUint64(&a.droppedErrors)
+}
+
+// Report whether e came from the connection currently in use.
+func (a *Apn) isCurrent(e NotificationError) bool {
+	return e.generation == atomic.LoadUint32(&a.generation)
+}
@@ -0,0 +1,3123 @@
+package apns
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Make a self-signed certificate for 127.0.0.1, usable by both ends.
+func testCertificate(t testing.TB) (certPEM, keyPEM []byte) {
+	return testCertificateNamed(t, "127.0.0.1")
+}
+
+func testCertificateNamed(t testing.TB, commonName string) (certPEM, keyPEM []byte) {
+	return testCertificateExpiring(t, commonName, time.Now().Add(365*24*time.Hour))
+}
+
+func testCertificateExpiring(t testing.TB, commonName string, notAfter time.Time, dnsNames ...string) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("can't generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             notAfter.Add(-2 * 365 * 24 * time.Hour),
+		NotAfter:              notAfter,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:              dnsNames,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("can't create certificate: %s", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("can't marshal key: %s", err)
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return
+}
+
+type testFrame struct {
+	command    uint8
+	priority   uint8
+	identifier uint32
+	expiry     uint32
+	token      string
+	payload    string
+}
+
+// A fake Apple gateway. Every frame it accepts goes to frames; when reject
+// returns a non-zero status for a frame, it replies with that status and
+// drops the rest of the connection like Apple does.
+type testServer struct {
+	listener net.Listener
+	conf     *tls.Config
+	certPEM  []byte
+	keyPEM   []byte
+	frames   chan testFrame
+	peers    chan *x509.Certificate
+	names    chan string
+	reject   func(f testFrame) uint8
+	accepted int32
+
+	// nanoseconds to stall before the TLS handshake, to play a slow server
+	handshakeDelay int64
+}
+
+func TestNewWithConn(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	client, server := net.Pipe()
+	go s.serve(tls.Server(server, s.conf))
+
+	apn, err := NewWithConn(client, s.certPEM, s.keyPEM, 0, WithServerName("127.0.0.1"))
+	if err != nil {
+		t.Fatalf("can't create apn: %s", err)
+	}
+	defer apn.Close()
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(s.certPEM)
+	apn.conf.RootCAs = pool
+
+	if err := apn.Send(testNotification(testToken(0x01), "hello")); err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+	if got, expect := (<-s.frames).token, testToken(0x01); got != expect {
+		t.Errorf("got: %s, expect: %s", got, expect)
+	}
+	if got, expect := apn.Reconnect(), ErrConnUsed; !errors.Is(got, expect) {
+		t.Errorf("got: %v, expect: %s", got, expect)
+	}
+}
+
+func newTestServer(t testing.TB, reject func(f testFrame) uint8) *testServer {
+	certPEM, keyPEM := testCertificate(t)
+	certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("can't load certificate: %s", err)
+	}
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		ClientAuth:   tls.RequestClientCert,
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", conf)
+	if err != nil {
+		t.Fatalf("can't listen: %s", err)
+	}
+	s := &testServer{
+		listener: listener,
+		conf:     conf,
+		certPEM:  certPEM,
+		keyPEM:   keyPEM,
+		frames:   make(chan testFrame, 100),
+		peers:    make(chan *x509.Certificate, 100),
+		names:    make(chan string, 100),
+		reject:   reject,
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&s.accepted, 1)
+			go s.serve(conn.(*tls.Conn))
+		}
+	}()
+	return s
+}
+
+func (s *testServer) serve(conn *tls.Conn) {
+	defer conn.Close()
+	time.Sleep(time.Duration(atomic.LoadInt64(&s.handshakeDelay)))
+	if err := conn.Handshake(); err != nil {
+		return
+	}
+	if peers := conn.ConnectionState().PeerCertificates; len(peers) > 0 {
+		s.peers <- peers[0]
+	}
+	select {
+	case s.names <- conn.ConnectionState().ServerName:
+	default:
+	}
+	for {
+		f, err := readTestFrame(conn)
+		if err != nil {
+			return
+		}
+		if s.reject != nil {
+			if status := s.reject(f); status != 0 {
+				p := []byte{8, status, 0, 0, 0, 0}
+				binary.BigEndian.PutUint32(p[2:], f.identifier)
+				conn.Write(p)
+				conn.CloseWrite()
+				io.Copy(ioutil.Discard, conn)
+				return
+			}
+		}
+		s.frames <- f
+	}
+}
+
+// Read a notification in either the enhanced or the framed format.
+func readTestFrame(r io.Reader) (f testFrame, err error) {
+	var command uint8
+	if err = binary.Read(r, binary.BigEndian, &command); err != nil {
+		return
+	}
+	f.command = command
+	if command == 2 {
+		var length uint32
+		if err = binary.Read(r, binary.BigEndian, &length); err != nil {
+			return
+		}
+		items := make([]byte, length)
+		if _, err = io.ReadFull(r, items); err != nil {
+			return
+		}
+		for len(items) >= 3 {
+			id, size := items[0], binary.BigEndian.Uint16(items[1:3])
+			data := items[3 : 3+size]
+			items = items[3+size:]
+			switch id {
+			case 1:
+				f.token = hex.EncodeToString(data)
+			case 2:
+				f.payload = string(data)
+			case 3:
+				f.identifier = binary.BigEndian.Uint32(data)
+			case 4:
+				f.expiry = binary.BigEndian.Uint32(data)
+			case 5:
+				f.priority = data[0]
+			}
+		}
+		return
+	}
+
+	var header struct {
+		Identifier uint32
+		Expiry     uint32
+		TokenLen   uint16
+	}
+	if err = binary.Read(r, binary.BigEndian, &header); err != nil {
+		return
+	}
+	token := make([]byte, header.TokenLen)
+	if _, err = io.ReadFull(r, token); err != nil {
+		return
+	}
+	var payloadLen uint16
+	if err = binary.Read(r, binary.BigEndian, &payloadLen); err != nil {
+		return
+	}
+	payload := make([]byte, payloadLen)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+	f.identifier, f.expiry = header.Identifier, header.Expiry
+	f.token, f.payload = hex.EncodeToString(token), string(payload)
+	return
+}
+
+func (s *testServer) Close() {
+	s.listener.Close()
+}
+
+// New Apn connecting to s, trusting its certificate.
+func newTestApn(t *testing.T, s *testServer, timeout time.Duration, opts ...Option) *Apn {
+	opts = append([]Option{WithTimeout(timeout)}, opts...)
+	apn, err := NewWithOptions(s.certPEM, s.keyPEM, s.listener.Addr().String(), opts...)
+	if err != nil {
+		t.Fatalf("can't create apn: %s", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(s.certPEM)
+	apn.conf.RootCAs = pool
+	apn.conf.ServerName = "127.0.0.1"
+	return apn
+}
+
+func testToken(b byte) string {
+	token := make([]byte, 32)
+	for i := range token {
+		token[i] = b
+	}
+	return hex.EncodeToString(token)
+}
+
+func testNotification(token string, body string) *Notification {
+	payload := &Payload{}
+	payload.Aps.AlertString = body
+	return &Notification{DeviceToken: token, Payload: payload}
+}
+
+func TestReadErrorDropsStaleGeneration(t *testing.T) {
+	{
+		apn := &Apn{errorChan: make(chan error, 1), generation: 2}
+		client, server := net.Pipe()
+		quit := make(chan *NotificationError, 1)
+		go readError(apn, client, 1, quit)
+
+		server.Write([]byte{8, 8, 0, 0, 0, 1})
+		server.Close()
+
+		select {
+		case <-quit:
+		case <-time.After(time.Second):
+			t.Fatalf("readError didn't quit")
+		}
+		select {
+		case e := <-apn.errorChan:
+			t.Errorf("got stale error: %s", e)
+		default:
+		}
+	}
+
+	{
+		apn := &Apn{errorChan: make(chan error, 1), generation: 1}
+		client, server := net.Pipe()
+		quit := make(chan *NotificationError, 1)
+		go readError(apn, client, 1, quit)
+
+		server.Write([]byte{8, 8, 0, 0, 0, 1})
+		e := <-apn.errorChan
+		if got, expect := e.Error(), "Invalid token(8): id(1)"; got != expect {
+			t.Errorf("got: %s, expect: %s", got, expect)
+		}
+		server.Close()
+		if last := <-quit; last == nil || last.Identifier != 1 {
+			t.Errorf("got: %v, expect the error response for id(1)", last)
+		}
+		// closing after the error response isn't reported again
+		if got := len(apn.errorChan); got != 0 {
+			t.Errorf("got %d more errors, expect 0", got)
+		}
+	}
+
+	{
+		apn := &Apn{errorChan: make(chan error, 1), generation: 1, connSends: 1}
+		client, server := net.Pipe()
+		quit := make(chan *NotificationError, 1)
+		go readError(apn, client, 1, quit)
+
+		// nor a close after a send
+		server.Close()
+		if got := <-apn.errorChan; errors.Is(got, ErrConnectionRefusedByApple) {
+			t.Errorf("got: %s, expect io.EOF", got)
+		}
+	}
+}
+
+func TestResendAfterError(t *testing.T) {
+	bad := testToken(0xbb)
+	s := newTestServer(t, func(f testFrame) uint8 {
+		if f.token == bad {
+			time.Sleep(100 * time.Millisecond)
+			return 8
+		}
+		return 0
+	})
+	defer s.Close()
+	apn := newTestApn(t, s, time.Second)
+	go func() {
+		for range apn.ErrorChan {
+		}
+	}()
+
+	for _, n := range []*Notification{
+		testNotification(testToken(0x01), "first"),
+		testNotification(bad, "bad"),
+		testNotification(testToken(0x02), "second"),
+	} {
+		if err := apn.Send(n); err != nil {
+			t.Fatalf("send error: %s", err)
+		}
+	}
+
+	for _, expect := range []string{testToken(0x01), testToken(0x02)} {
+		select {
+		case f := <-s.frames:
+			if f.token != expect {
+				t.Errorf("got: %s, expect: %s", f.token, expect)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting for %s", expect)
+		}
+	}
+}
+
+func TestResendKeepsExpiry(t *testing.T) {
+	bad := testNotification(testToken(0xbb), "bad")
+	n := testNotification(testToken(0x01), "first")
+	n.ExpireAfterSeconds = 60
+	apn := &Apn{inflight: []inFlight{{identifier: 1, notification: bad, expiry: 1000}, {identifier: 2, notification: n, expiry: 1060}}}
+
+	apn.requeue(&NotificationError{Command: 8, Status: 8, Identifier: 1})
+	if len(apn.resend) != 1 {
+		t.Fatalf("got %d to resend, expect 1", len(apn.resend))
+	}
+	if got, expect := apn.resend[0].expiry(time.Now()), uint32(1060); got != expect {
+		t.Errorf("got expiry: %d, expect: %d", got, expect)
+	}
+	if n.ExpiryUnix != 0 {
+		t.Errorf("requeue changed the caller's notification")
+	}
+}
+
+func TestZeroTimeoutKeepsConnection(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	apn := newTestApn(t, s, 0)
+
+	for i := 0; i < 3; i++ {
+		if err := apn.Send(testNotification(testToken(0x01), "hello")); err != nil {
+			t.Fatalf("send error: %s", err)
+		}
+		<-s.frames
+		time.Sleep(50 * time.Millisecond)
+	}
+	if got := atomic.LoadInt32(&s.accepted); got != 1 {
+		t.Errorf("got %d connections, expect 1", got)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	apn := newTestApn(t, s, time.Second)
+
+	if err := apn.Reconnect(); err != nil {
+		t.Fatalf("reconnect error: %s", err)
+	}
+	if err := apn.Send(testNotification(testToken(0x01), "hello")); err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+	<-s.frames
+	if err := apn.Reconnect(); err != nil {
+		t.Fatalf("reconnect error: %s", err)
+	}
+	if err := apn.Send(testNotification(testToken(0x01), "hello")); err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+	<-s.frames
+	if got := atomic.LoadInt32(&s.accepted); got != 2 {
+		t.Errorf("got %d connections, expect 2", got)
+	}
+}
+
+func TestSwitchServer(t *testing.T) {
+	s1 := newTestServer(t, nil)
+	defer s1.Close()
+	s2 := newTestServer(t, nil)
+	defer s2.Close()
+	apn := newTestApn(t, s1, time.Second)
+	defer apn.Close()
+	// s2 is localhost
+	certPEM, keyPEM := testCertificateExpiring(t, "localhost", time.Now().Add(time.Hour), "localhost")
+	certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("can't load certificate: %s", err)
+	}
+	s2.conf.Certificates = []tls.Certificate{certificate}
+	apn.conf.RootCAs.AppendCertsFromPEM(certPEM)
+
+	if err := apn.Send(testNotification(testToken(0x01), "first")); err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+	<-s1.frames
+	// by name, so the name the server sees moves along
+	_, port, _ := net.SplitHostPort(s2.listener.Addr().String())
+	if err := apn.SwitchServer(net.JoinHostPort("localhost", port)); err != nil {
+		t.Fatalf("switch error: %s", err)
+	}
+	if got, expect := <-s2.names, "localhost"; got != expect {
+		t.Errorf("got server name %s, expect %s", got, expect)
+	}
+	if err := apn.Send(testNotification(testToken(0x02), "second")); err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+	select {
+	case f := <-s2.frames:
+		if got, expect := f.token, testToken(0x02); got != expect {
+			t.Errorf("got: %s, expect: %s", got, expect)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("send didn't move to the new server")
+	}
+
+	// a failed switch stays on the server
+	if err := apn.SwitchServer("127.0.0.1:1"); err == nil {
+		t.Fatalf("switch to a closed port succeeded")
+	}
+	if err := apn.Send(testNotification(testToken(0x03), "third")); err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+	<-s2.frames
+	if got := atomic.LoadInt32(&s1.accepted); got != 1 {
+		t.Errorf("got %d connections to the old server, expect 1", got)
+	}
+}
+
+func TestReconnectResendsDropped(t *testing.T) {
+	bad := testNotification(testToken(0xbb), "bad")
+	n := testNotification(testToken(0x01), "first")
+	apn := &Apn{inflight: []inFlight{{identifier: 1, notification: bad, expiry: 1000}, {identifier: 2, notification: n, expiry: 1060}}}
+	quit := make(chan *NotificationError, 1)
+	quit <- &NotificationError{Command: 8, Status: 8, Identifier: 1}
+
+	if err := apn.drain(quit); err != nil {
+		t.Fatalf("drain error: %s", err)
+	}
+	if len(apn.resend) != 1 || apn.resend[0].DeviceToken != n.DeviceToken {
+		t.Errorf("got %d to resend, expect only %s", len(apn.resend), n.DeviceToken)
+	}
+}
+
+func TestSendNil(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	apn := newTestApn(t, s, time.Second, WithCoalesceBadgeUpdates(time.Millisecond))
+	defer apn.Close()
+
+	if got, expect := apn.Send(nil), ErrNilNotification; got != expect {
+		t.Errorf("got: %v, expect: %s", got, expect)
+	}
+	errs := apn.SendBatch(context.Background(), []*Notification{nil})
+	if got, expect := errs[0], ErrNilNotification; got != expect {
+		t.Errorf("got: %v, expect: %s", got, expect)
+	}
+	if got := atomic.LoadInt32(&s.accepted); got != 0 {
+		t.Errorf("got %d connections, expect 0", got)
+	}
+}
+
+func TestUpdateCertificate(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	apn := newTestApn(t, s, time.Second)
+
+	if err := apn.Send(testNotification(testToken(0x01), "hello")); err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+	<-s.frames
+	if got := <-s.peers; !bytes.Equal(got.Raw, pemBytes(s.certPEM)) {
+		t.Errorf("server didn't get the first certificate")
+	}
+
+	certPEM, keyPEM := testCertificate(t)
+	if err := apn.UpdateCertificate(certPEM, keyPEM); err != nil {
+		t.Fatalf("update certificate error: %s", err)
+	}
+	if err := apn.Send(testNotification(testToken(0x01), "hello")); err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+	<-s.frames
+	if got := <-s.peers; !bytes.Equal(got.Raw, pemBytes(certPEM)) {
+		t.Errorf("server didn't get the new certificate")
+	}
+
+	if err := apn.UpdateCertificate(certPEM, s.keyPEM); err == nil {
+		t.Errorf("mismatched key pair should fail")
+	}
+}
+
+func pemBytes(p []byte) []byte {
+	block, _ := pem.Decode(p)
+	return block.Bytes
+}
+
+func TestSendBatchDeadline(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	atomic.StoreInt64(&s.handshakeDelay, int64(300*time.Millisecond))
+	apn := newTestApn(t, s, time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	errs := apn.SendBatch(ctx, []*Notification{
+		testNotification(testToken(0x01), "first"),
+		testNotification(testToken(0x02), "second"),
+		testNotification(testToken(0x03), "third"),
+	})
+	if errs[0] != nil {
+		t.Errorf("got: %s, expect the first notification sent", errs[0])
+	}
+	for _, err := range errs[1:] {
+		if err != context.DeadlineExceeded {
+			t.Errorf("got: %v, expect: %s", err, context.DeadlineExceeded)
+		}
+	}
+}
+
+func TestWarmConnection(t *testing.T) {
+	for _, warm := range []bool{false, true} {
+		s := newTestServer(t, nil)
+		atomic.StoreInt64(&s.handshakeDelay, int64(200*time.Millisecond))
+		opts := []Option{}
+		if warm {
+			opts = append(opts, WithWarmConnection())
+		}
+		apn := newTestApn(t, s, 300*time.Millisecond, opts...)
+
+		if err := apn.Send(testNotification(testToken(0x01), "first")); err != nil {
+			t.Fatalf("send error: %s", err)
+		}
+		// idled out, and warmed up again if warm, but not idled out again
+		time.Sleep(650 * time.Millisecond)
+		start := time.Now()
+		if err := apn.Send(testNotification(testToken(0x02), "second")); err != nil {
+			t.Fatalf("send error: %s", err)
+		}
+		if took := time.Since(start); warm != (took < 150*time.Millisecond) {
+			t.Errorf("warm %t: second send took %s", warm, took)
+		}
+		if got := atomic.LoadInt32(&s.accepted); got != 2 {
+			t.Errorf("warm %t: got %d connections, expect 2", warm, got)
+		}
+		apn.Close()
+		s.Close()
+	}
+}
+
+type testLogger struct {
+	lines chan string
+}
+
+func (l testLogger) Printf(format string, v ...interface{}) {
+	l.lines <- fmt.Sprintf(format, v...)
+}
+
+func TestInFlightSnapshot(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	apn := newTestApn(t, s, time.Minute, WithTokenRedaction(4))
+	defer apn.Close()
+	// the first send waits for the handshake, after it was enqueued
+	atomic.StoreInt64(&s.handshakeDelay, int64(200*time.Millisecond))
+
+	var ids []uint32
+	var enqueued []time.Time
+	for i := 0; i < 3; i++ {
+		enqueued = append(enqueued, time.Now())
+		id, err := apn.SendID(testNotification(testToken(byte(i)), "hello"))
+		if err != nil {
+			t.Fatalf("send error: %s", err)
+		}
+		<-s.frames
+		ids = append(ids, id)
+	}
+	entries := apn.InFlightSnapshot()
+	if len(entries) != 3 {
+		t.Fatalf("got %d entries, expect 3", len(entries))
+	}
+	for i, e := range entries {
+		token := redactToken(testToken(byte(i)), 4)
+		if e.Identifier != ids[i] || e.Token != token {
+			t.Errorf("got: %+v, expect id(%x) to %s", e, ids[i], token)
+		}
+		if d := e.Enqueued.Sub(enqueued[i]); d < 0 || d > 100*time.Millisecond {
+			t.Errorf("got enqueued %s after the send, expect within 100ms", d)
+		}
+	}
+	entries[0].Token = ""
+	if got := apn.InFlightSnapshot()[0].Token; got != redactToken(testToken(0), 4) {
+		t.Errorf("got: %s, expect a copy", got)
+	}
+}
+
+func TestCurrentIdentifier(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	apn := newTestApn(t, s, time.Second)
+	defer apn.Close()
+
+	for i := 0; i < 3; i++ {
+		expect := apn.CurrentIdentifier()
+		id, err := apn.SendID(testNotification(testToken(0x01), "hello"))
+		if err != nil {
+			t.Fatalf("send error: %s", err)
+		}
+		<-s.frames
+		if id != expect {
+			t.Errorf("got id(%x), expect: id(%x)", id, expect)
+		}
+		if got := apn.CurrentIdentifier(); got != expect+1 {
+			t.Errorf("got: %x, expect: %x", got, expect+1)
+		}
+	}
+}
+
+func TestSendAndWait(t *testing.T) {
+	bad := testToken(0xbb)
+	s := newTestServer(t, func(f testFrame) uint8 {
+		if f.token == bad {
+			return 8
+		}
+		return 0
+	})
+	defer s.Close()
+	apn := newTestApn(t, s, time.Second)
+	defer apn.Close()
+	go func() {
+		for range apn.ErrorChan {
+		}
+	}()
+
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		_, err := apn.SendAndWait(ctx, testNotification(testToken(0x01), "hello"))
+		cancel()
+		if err != nil {
+			t.Errorf("got: %s, expect no error", err)
+		}
+	}
+
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		id, err := apn.SendAndWait(ctx, testNotification(bad, "hello"))
+		cancel()
+		e, ok := err.(NotificationError)
+		if !ok || e.Status != 8 || e.Identifier != id {
+			t.Errorf("got: %v, expect invalid token for id(%x)", err, id)
+		}
+	}
+}
+
+func TestNotificationMeta(t *testing.T) {
+	bad := testToken(0xbb)
+	s := newTestServer(t, func(f testFrame) uint8 {
+		if f.token == bad {
+			return 8
+		}
+		return 0
+	})
+	defer s.Close()
+	dropped := make(chan interface{}, 1)
+	apn := newTestApn(t, s, time.Second, WithOnDropped(func(n *Notification, reason error) {
+		dropped <- n.Meta
+	}))
+	defer apn.Close()
+
+	n := testNotification(bad, "hello")
+	n.Meta = "order-1"
+	if err := apn.Send(n); err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+	select {
+	case err := <-apn.ErrorChan:
+		e, ok := err.(NotificationError)
+		if !ok || e.Meta() != "order-1" {
+			t.Errorf("got: %v, expect meta order-1", err)
+		}
+		if ok && e.Notification() != n {
+			t.Errorf("got: %v, expect the notification sent", e.Notification())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no error")
+	}
+	select {
+	case got := <-dropped:
+		if got != "order-1" {
+			t.Errorf("got: %v, expect: order-1", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("not dropped")
+	}
+
+	if got := (NotificationError{}).Meta(); got != nil {
+		t.Errorf("got: %v, expect nil", got)
+	}
+}
+
+func TestOnReconnect(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	calls := int32(0)
+	apn := newTestApn(t, s, time.Second, WithOnReconnect(func() []*Notification {
+		atomic.AddInt32(&calls, 1)
+		return []*Notification{testNotification(testToken(0x0a), "state")}
+	}))
+	defer apn.Close()
+
+	if err := apn.Send(testNotification(testToken(0x01), "first")); err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+	if got := (<-s.frames).token; got != testToken(0x01) {
+		t.Errorf("got: %s, expect no warm up on the first connection", got)
+	}
+	if err := apn.Reconnect(); err != nil {
+		t.Fatalf("reconnect error: %s", err)
+	}
+	if err := apn.Send(testNotification(testToken(0x02), "second")); err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+	for _, expect := range []string{testToken(0x0a), testToken(0x02)} {
+		if got := (<-s.frames).token; got != expect {
+			t.Errorf("got: %s, expect: %s", got, expect)
+		}
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("got %d calls, expect 1", got)
+	}
+}
+
+func TestOnRawRead(t *testing.T) {
+	bad := testToken(0xbb)
+	s := newTestServer(t, func(f testFrame) uint8 {
+		if f.token == bad {
+			return 8
+		}
+		return 0
+	})
+	defer s.Close()
+	reads := make(chan []byte, 4)
+	apn := newTestApn(t, s, time.Second, WithOnRawRead(func(p []byte) {
+		reads <- p
+	}))
+	defer apn.Close()
+	go func() {
+		for range apn.ErrorChan {
+		}
+	}()
+
+	id, err := apn.SendID(testNotification(bad, "hello"))
+	if err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+	expect := []byte{8, 8, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(expect[2:], id)
+	select {
+	case got := <-reads:
+		if !bytes.Equal(got, expect) {
+			t.Errorf("got: %x, expect: %x", got, expect)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no read")
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	s := newTestServer(t, func(f testFrame) uint8 {
+		if f.token == selfTestToken {
+			return 8
+		}
+		return 0
+	})
+	defer s.Close()
+	silent := newTestServer(t, nil)
+	defer silent.Close()
+
+	for _, c := range []struct {
+		s       *testServer
+		timeout time.Duration
+		expect  error
+	}{
+		{s, 2 * time.Second, nil},
+		{silent, 200 * time.Millisecond, ErrSelfTestUnconfirmed},
+	} {
+		apn := newTestApn(t, c.s, time.Second)
+		go func() {
+			for range apn.ErrorChan {
+			}
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+		err := apn.SelfTest(ctx)
+		cancel()
+		apn.Close()
+		if err != c.expect {
+			t.Errorf("got: %v, expect: %v", err, c.expect)
+		}
+	}
+
+	{
+		silent.Close()
+		apn := newTestApn(t, silent, time.Second)
+		defer apn.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		err := apn.SelfTest(ctx)
+		cancel()
+		if err == nil || err == ErrSelfTestUnconfirmed {
+			t.Errorf("got: %v, expect a connection error", err)
+		}
+	}
+}
+
+func TestSendStream(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	apn := newTestApn(t, s, time.Second)
+	defer apn.Close()
+
+	in := make(chan *Notification)
+	results := make(chan SendResult)
+	done := make(chan struct{})
+	go func() {
+		apn.SendStream(context.Background(), in, results)
+		close(done)
+	}()
+
+	const n = 5
+	go func() {
+		for i := 0; i < n; i++ {
+			in <- testNotification(testToken(byte(i+1)), "hello")
+		}
+		close(in)
+	}()
+	for i := 0; i < n; i++ {
+		r := <-results
+		if r.Err != nil || r.Token != testToken(byte(i+1)) {
+			t.Errorf("got: %+v, expect %s sent", r, testToken(byte(i+1)))
+		}
+		if f := <-s.frames; f.identifier != r.Identifier {
+			t.Errorf("got frame id(%d), expect id(%d)", f.identifier, r.Identifier)
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("SendStream didn't return after in was closed")
+	}
+	if got := atomic.LoadInt32(&s.accepted); got != 1 {
+		t.Errorf("got %d connections, expect 1", got)
+	}
+}
+
+func TestSendBatchPolicy(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	batch := []*Notification{
+		testNotification(testToken(0x01), "1"),
+		testNotification(testToken(0x02), "2"),
+		testNotification("0303", "3"),
+		testNotification(testToken(0x04), "4"),
+		testNotification(testToken(0x05), "5"),
+	}
+
+	for _, c := range []struct {
+		policy BatchPolicy
+		expect []error
+		sent   int
+	}{
+		{StopOnSendError, []error{nil, nil, ErrInvalidTokenSize, ErrNotAttempted, ErrNotAttempted}, 2},
+		{ContinueOnSendError, []error{nil, nil, ErrInvalidTokenSize, nil, nil}, 4},
+	} {
+		apn := newTestApn(t, s, time.Second, WithBatchPolicy(c.policy))
+		errs := apn.SendBatch(context.Background(), batch)
+		for i, got := range errs {
+			if got != c.expect[i] {
+				t.Errorf("policy %d notification %d got: %v, expect: %v", c.policy, i+1, got, c.expect[i])
+			}
+		}
+		for i := 0; i < c.sent; i++ {
+			<-s.frames
+		}
+		apn.Close()
+	}
+	select {
+	case f := <-s.frames:
+		t.Errorf("got unexpected frame: %+v", f)
+	default:
+	}
+}
+
+func TestSendBatchAppleRejection(t *testing.T) {
+	bad := testToken(0x03)
+	s := newTestServer(t, func(f testFrame) uint8 {
+		if f.token == bad {
+			time.Sleep(100 * time.Millisecond)
+			return 8
+		}
+		return 0
+	})
+	defer s.Close()
+	apn := newTestApn(t, s, time.Second)
+	defer apn.Close()
+
+	var batch []*Notification
+	for i := 1; i <= 5; i++ {
+		batch = append(batch, testNotification(testToken(byte(i)), "hello"))
+	}
+	// all were sent, Apple rejects the 3rd later
+	for i, err := range apn.SendBatch(context.Background(), batch) {
+		if err != nil {
+			t.Errorf("notification %d got: %s", i+1, err)
+		}
+	}
+	e := (<-apn.ErrorChan).(NotificationError)
+	if e.Status != 8 || e.notification.DeviceToken != bad {
+		t.Errorf("got: %s, expect the 3rd rejected", e)
+	}
+	// and the ones Apple dropped after it are resent
+	for _, expect := range []string{testToken(0x01), testToken(0x02), testToken(0x04), testToken(0x05)} {
+		select {
+		case f := <-s.frames:
+			if f.token != expect {
+				t.Errorf("got: %s, expect: %s", f.token, expect)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting for %s", expect)
+		}
+	}
+}
+
+func TestOptions(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	logger := testLogger{make(chan string, 10)}
+	apn := newTestApn(t, s, time.Second, WithMaxPayloadBytes(32), WithLogger(logger), WithDialTimeout(time.Second), WithIdlePing(time.Second))
+
+	if err := apn.Send(testNotification(testToken(0x01), "hello")); err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+	if got, expect := <-logger.lines, "connected to "+s.listener.Addr().String()+" (custom, topic unknown)"; got != expect {
+		t.Errorf("got: %s, expect: %s", got, expect)
+	}
+	if err := apn.Send(testNotification(testToken(0x01), "hello world, this is too long")); err == nil {
+		t.Errorf("payload over 32 bytes should fail")
+	}
+}
+
+func TestSendInvalidTokenSize(t *testing.T) {
+	apn := &Apn{maxPayloadBytes: maxPayloadBytes}
+	token := hex.EncodeToString(make([]byte, 40))
+	// apn has no connection, so getting past the check would panic.
+	if _, got := apn.send(testNotification(token, "hello")); got != ErrInvalidTokenSize {
+		t.Errorf("got: %v, expect: %s", got, ErrInvalidTokenSize)
+	}
+}
+
+func TestNotificationValidate(t *testing.T) {
+	large := testNotification(testToken(0x01), strings.Repeat("x", 300))
+	unmarshalable := testNotification(testToken(0x01), "hello")
+	unmarshalable.Payload.SetCustom("acme", func() {})
+	priority := testNotification(testToken(0x01), "hello")
+	priority.Priority = 7
+	customOnly := &Notification{DeviceToken: testToken(0x01), Payload: &Payload{}}
+	customOnly.Payload.SetCustom("id", 7)
+	var tooLarge *PayloadTooLargeError
+	var marshal *MarshalError
+
+	for _, c := range []struct {
+		n     *Notification
+		check func(error) bool
+	}{
+		{testNotification("", "hello"), func(err error) bool { return err == ErrEmptyDeviceToken }},
+		{testNotification("0102", "hello"), func(err error) bool { return err == ErrInvalidTokenSize }},
+		{testNotification("not a token!", "hello"), func(err error) bool { return err != nil }},
+		{priority, func(err error) bool { return err == ErrInvalidPriority }},
+		{&Notification{DeviceToken: testToken(0x01)}, func(err error) bool { return err == ErrMissingPayload }},
+		{&Notification{DeviceToken: testToken(0x01), Payload: &Payload{}}, func(err error) bool { return err == ErrEmptyAlertPayload }},
+		{customOnly, func(err error) bool { return err == ErrEmptyAlertPayload }},
+		{&Notification{DeviceToken: testToken(0x01), Payload: &Payload{Aps: Aps{ContentAvailable: true}}}, func(err error) bool { return err == nil }},
+		{&Notification{DeviceToken: testToken(0x01), Payload: &Payload{Aps: Aps{Badge: 1}}}, func(err error) bool { return err == nil }},
+		{unmarshalable, func(err error) bool { return errors.As(err, &marshal) }},
+		{large, func(err error) bool { return errors.As(err, &tooLarge) }},
+		{testNotification(testToken(0x01), "hello"), func(err error) bool { return err == nil }},
+	} {
+		if err := c.n.Validate(); !c.check(err) {
+			t.Errorf("%q got: %v", c.n.DeviceToken, err)
+		}
+	}
+}
+
+func TestSendEmptyDeviceToken(t *testing.T) {
+	apn := &Apn{maxPayloadBytes: maxPayloadBytes, dryRun: true}
+	for _, c := range []struct {
+		token  string
+		expect error
+	}{
+		{"", ErrEmptyDeviceToken},
+		{" \t\n", ErrEmptyDeviceToken},
+		{testToken(0x01), nil},
+	} {
+		if _, got := apn.send(testNotification(c.token, "hello")); got != c.expect {
+			t.Errorf("token %q got: %v, expect: %v", c.token, got, c.expect)
+		}
+	}
+}
+
+func TestPeerCertificates(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	apn := newTestApn(t, s, time.Second)
+
+	if got := apn.PeerCertificates(); got != nil {
+		t.Errorf("got %d certificates before connecting, expect none", len(got))
+	}
+	if err := apn.Reconnect(); err != nil {
+		t.Fatalf("reconnect error: %s", err)
+	}
+	got := apn.PeerCertificates()
+	if len(got) != 1 || !bytes.Equal(got[0].Raw, pemBytes(s.certPEM)) {
+		t.Errorf("didn't get the server certificate")
+	}
+}
+
+func TestConnectionState(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	apn := newTestApn(t, s, time.Second)
+
+	if _, err := apn.ConnectionState(); err != ErrNotConnected {
+		t.Errorf("got: %v, expect: %s", err, ErrNotConnected)
+	}
+	if err := apn.Reconnect(); err != nil {
+		t.Fatalf("reconnect error: %s", err)
+	}
+	if state, err := apn.ConnectionState(); err != nil || !state.HandshakeComplete {
+		t.Errorf("got: %v, expect a completed handshake", err)
+	}
+	if err := apn.Close(); err != nil {
+		t.Errorf("close error: %s", err)
+	}
+	if _, err := apn.ConnectionState(); err != ErrNotConnected {
+		t.Errorf("got: %v after Close, expect: %s", err, ErrNotConnected)
+	}
+	if err := apn.Close(); err != nil {
+		t.Errorf("second close error: %s", err)
+	}
+}
+
+func TestLocalAddr(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	apn := newTestApn(t, s, time.Second, WithLocalAddr(local))
+	defer apn.Close()
+
+	if got := apn.dialer().LocalAddr; got != local {
+		t.Errorf("got local address: %v, expect: %v", got, local)
+	}
+	if err := apn.Send(testNotification(testToken(0x01), "hello")); err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+	<-s.frames
+}
+
+// Records SetNoDelay like a *net.TCPConn would take it.
+type noDelayConn struct {
+	net.Conn
+	noDelay chan bool
+}
+
+func (c noDelayConn) SetNoDelay(noDelay bool) error {
+	c.noDelay <- noDelay
+	return nil
+}
+
+func TestRootCAs(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	other, _ := testCertificate(t)
+
+	for _, c := range []struct {
+		root   []byte
+		expect bool
+	}{
+		{s.certPEM, true},
+		{other, false},
+	} {
+		roots := x509.NewCertPool()
+		roots.AppendCertsFromPEM(c.root)
+		apn, err := NewWithOptions(s.certPEM, s.keyPEM, s.listener.Addr().String(), WithRootCAs(roots))
+		if err != nil {
+			t.Fatalf("can't create apn: %s", err)
+		}
+		err = apn.Reconnect()
+		apn.Close()
+		if got := err == nil; got != c.expect {
+			t.Errorf("got connect error: %v, expect connected: %t", err, c.expect)
+		}
+	}
+}
+
+func TestNoDelay(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+
+	for _, expect := range []bool{true, false} {
+		noDelay := make(chan bool, 1)
+		opts := []Option{WithDialFunc(func(network, addr string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go s.serve(tls.Server(server, s.conf))
+			return noDelayConn{client, noDelay}, nil
+		})}
+		if !expect {
+			opts = append(opts, WithNoDelay(false))
+		}
+		apn := newTestApn(t, s, time.Second, opts...)
+		if err := apn.Reconnect(); err != nil {
+			t.Fatalf("connect error: %s", err)
+		}
+		if got := <-noDelay; got != expect {
+			t.Errorf("got no delay: %t, expect: %t", got, expect)
+		}
+		apn.Close()
+	}
+}
+
+func TestDialFunc(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	dialed := make(chan string, 1)
+	apn := newTestApn(t, s, time.Second, WithDialFunc(func(network, addr string) (net.Conn, error) {
+		dialed <- addr
+		client, server := net.Pipe()
+		go s.serve(tls.Server(server, s.conf))
+		return client, nil
+	}))
+
+	if err := apn.Send(testNotification(testToken(0x01), "hello")); err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+	if got, expect := (<-s.frames).token, testToken(0x01); got != expect {
+		t.Errorf("got: %s, expect: %s", got, expect)
+	}
+	if got, expect := <-dialed, s.listener.Addr().String(); got != expect {
+		t.Errorf("got: %s, expect: %s", got, expect)
+	}
+	if got := atomic.LoadInt32(&s.accepted); got != 0 {
+		t.Errorf("got %d connections to the listener, expect 0", got)
+	}
+}
+
+func TestNetwork(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+
+	for _, c := range []struct {
+		network string
+		expect  bool
+	}{
+		{"tcp4", true},
+		{"tcp6", false},
+	} {
+		apn := newTestApn(t, s, time.Second, WithNetwork(c.network))
+		err := apn.Reconnect()
+		apn.Close()
+		if got := err == nil; got != c.expect {
+			t.Errorf("%s: got connect error: %v, expect connected: %t", c.network, err, c.expect)
+		}
+	}
+
+	dialed := make(chan string, 1)
+	apn := newTestApn(t, s, time.Second, WithNetwork("tcp4"), WithDialFunc(func(network, addr string) (net.Conn, error) {
+		dialed <- network
+		client, server := net.Pipe()
+		go s.serve(tls.Server(server, s.conf))
+		return client, nil
+	}))
+	defer apn.Close()
+	if err := apn.Reconnect(); err != nil {
+		t.Fatalf("connect error: %s", err)
+	}
+	if got := <-dialed; got != "tcp4" {
+		t.Errorf("got: %s, expect: tcp4", got)
+	}
+}
+
+func TestQueueDepthAndInFlight(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	atomic.StoreInt64(&s.handshakeDelay, int64(200*time.Millisecond))
+	apn := newTestApn(t, s, time.Second)
+
+	done := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			done <- apn.Send(testNotification(testToken(0x01), "hello"))
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	// one is being sent while connecting, the others wait for it
+	if got, expect := apn.QueueDepth(), 2; got != expect {
+		t.Errorf("got: %d, expect: %d", got, expect)
+	}
+	for i := 0; i < 3; i++ {
+		if err := <-done; err != nil {
+			t.Fatalf("send error: %s", err)
+		}
+	}
+	if got, expect := apn.QueueDepth(), 0; got != expect {
+		t.Errorf("got: %d, expect: %d", got, expect)
+	}
+	if got, expect := apn.InFlight(), 3; got != expect {
+		t.Errorf("got: %d, expect: %d", got, expect)
+	}
+}
+
+func TestSendPayloadErrors(t *testing.T) {
+	apn := &Apn{maxPayloadBytes: 32}
+
+	{
+		n := testNotification(testToken(0x01), "hello")
+		n.Payload.SetCustom("acme", func() {})
+		var e *MarshalError
+		if _, err := apn.send(n); !errors.As(err, &e) {
+			t.Errorf("got: %v, expect a MarshalError", err)
+		}
+	}
+
+	{
+		n := testNotification(testToken(0x01), "hello world, this is too long")
+		var e *PayloadTooLargeError
+		if _, err := apn.send(n); !errors.As(err, &e) {
+			t.Errorf("got: %v, expect a PayloadTooLargeError", err)
+		} else if e.Limit != 32 {
+			t.Errorf("got limit: %d, expect: 32", e.Limit)
+		}
+	}
+
+	{
+		n := testNotification(testToken(0x01), "hi")
+		n.Payload.SetCustom("debug", "0123456789abcdef")
+		var e *PayloadTooLargeError
+		if _, err := apn.send(n); !errors.As(err, &e) {
+			t.Errorf("got: %v, expect a PayloadTooLargeError", err)
+		} else if e.ApsBytes != len(`{"alert":"hi"}`) || e.CustomBytes != len(`{"aps":,"debug":"0123456789abcdef"}`) {
+			t.Errorf("got aps: %d, custom: %d bytes of %s", e.ApsBytes, e.CustomBytes, e.Payload)
+		}
+	}
+}
+
+func TestPayloadLimitBoundary(t *testing.T) {
+	apn := &Apn{maxPayloadBytes: 32, dryRun: true}
+
+	// {"aps":{"alert":""}} is 20 bytes, so a 12 byte alert is exactly 32.
+	if _, err := apn.send(testNotification(testToken(0x01), "0123456789ab")); err != nil {
+		t.Errorf("payload of exactly the limit got: %s", err)
+	}
+	var e *PayloadTooLargeError
+	if _, err := apn.send(testNotification(testToken(0x01), "0123456789abc")); !errors.As(err, &e) {
+		t.Errorf("payload over the limit got: %v, expect a PayloadTooLargeError", err)
+	} else if len(e.Payload) != 33 {
+		t.Errorf("got payload of %d bytes, expect 33", len(e.Payload))
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	certPEM, keyPEM := testCertificate(t)
+	apn, err := NewWithOptions(certPEM, keyPEM, "127.0.0.1:1", WithDryRun())
+	if err != nil {
+		t.Fatalf("can't create apn: %s", err)
+	}
+
+	if err := apn.Send(testNotification(testToken(0x01), "hello")); err != nil {
+		t.Errorf("send error: %s", err)
+	}
+	if got, expect := apn.Send(testNotification("0102", "hello")), ErrInvalidTokenSize; got != expect {
+		t.Errorf("got: %v, expect: %s", got, expect)
+	}
+
+	// there's no connection to drain
+	done := make(chan error, 1)
+	go func() {
+		if err := apn.Reconnect(); err != nil {
+			done <- err
+			return
+		}
+		if err := apn.Reconnect(); err != nil {
+			done <- err
+			return
+		}
+		done <- apn.UpdateCertificate(certPEM, keyPEM)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("reconnect error: %s", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("reconnecting a dry run hangs")
+	}
+	apn.Close()
+}
+
+func TestTokenFilter(t *testing.T) {
+	allowed := testToken(0x01)
+	certPEM, keyPEM := testCertificate(t)
+	apn, err := NewWithOptions(certPEM, keyPEM, "127.0.0.1:1", WithDryRun(), WithTokenFilter(func(token string) bool {
+		return token == allowed
+	}))
+	if err != nil {
+		t.Fatalf("can't create apn: %s", err)
+	}
+	defer apn.Close()
+
+	if err := apn.Send(testNotification(allowed, "hello")); err != nil {
+		t.Errorf("send error: %s", err)
+	}
+	if got, expect := apn.Send(testNotification(testToken(0x02), "hello")), ErrTokenFiltered; got != expect {
+		t.Errorf("got: %v, expect: %s", got, expect)
+	}
+}
+
+func TestAddValidator(t *testing.T) {
+	certPEM, keyPEM := testCertificate(t)
+	apn, err := NewWithOptions(certPEM, keyPEM, "127.0.0.1:1", WithDryRun())
+	if err != nil {
+		t.Fatalf("can't create apn: %s", err)
+	}
+	defer apn.Close()
+
+	errNoBadge := errors.New("no badge")
+	var ran []string
+	apn.AddValidator(func(n *Notification) error {
+		ran = append(ran, "badge")
+		if n.Payload.Aps.Badge == 0 {
+			return errNoBadge
+		}
+		return nil
+	})
+	apn.AddValidator(func(n *Notification) error {
+		ran = append(ran, "token")
+		return nil
+	})
+
+	n := testNotification(testToken(0x01), "hello")
+	if got := apn.Send(n); got != errNoBadge {
+		t.Errorf("got: %v, expect: %s", got, errNoBadge)
+	}
+	if got, expect := strings.Join(ran, ","), "badge"; got != expect {
+		t.Errorf("got: %s, expect: %s", got, expect)
+	}
+
+	ran = nil
+	n.Payload.Aps.Badge = 1
+	if err := apn.Send(n); err != nil {
+		t.Errorf("send error: %s", err)
+	}
+	if got, expect := strings.Join(ran, ","), "badge,token"; got != expect {
+		t.Errorf("got: %s, expect: %s", got, expect)
+	}
+}
+
+func TestErrorChanPolicy(t *testing.T) {
+	errs := []error{errors.New("1"), errors.New("2"), errors.New("3")}
+
+	{
+		apn := &Apn{errorChan: make(chan error, 2), errorChanPolicy: DropNewest}
+		for _, err := range errs {
+			apn.reportError(err)
+		}
+		if got, expect := (<-apn.errorChan).Error()+(<-apn.errorChan).Error(), "12"; got != expect {
+			t.Errorf("got: %s, expect: %s", got, expect)
+		}
+		if got, expect := apn.DroppedErrors(), uint64(1); got != expect {
+			t.Errorf("got: %d, expect: %d", got, expect)
+		}
+	}
+
+	{
+		apn := &Apn{errorChan: make(chan error, 2), errorChanPolicy: DropOldest}
+		for _, err := range errs {
+			apn.reportError(err)
+		}
+		if got, expect := (<-apn.errorChan).Error()+(<-apn.errorChan).Error(), "23"; got != expect {
+			t.Errorf("got: %s, expect: %s", got, expect)
+		}
+		if got, expect := apn.DroppedErrors(), uint64(1); got != expect {
+			t.Errorf("got: %d, expect: %d", got, expect)
+		}
+	}
+
+	{
+		apn := &Apn{errorChan: make(chan error), errorChanPolicy: DropOldest}
+		apn.reportError(errs[0])
+		if got, expect := apn.DroppedErrors(), uint64(1); got != expect {
+			t.Errorf("got: %d, expect: %d", got, expect)
+		}
+	}
+}
+
+func TestCloseStopsSendLoop(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	before := runtime.NumGoroutine()
+
+	apn := newTestApn(t, s, time.Second)
+	if err := apn.Send(testNotification(testToken(0x01), "hello")); err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+	<-s.frames
+	if err := apn.Close(); err != nil {
+		t.Errorf("close error: %s", err)
+	}
+	if got, expect := apn.Send(testNotification(testToken(0x01), "hello")), ErrClosed; got != expect {
+		t.Errorf("got: %v, expect: %s", got, expect)
+	}
+
+	// the server's goroutine for the connection exits with it
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := runtime.NumGoroutine(); got > before {
+		t.Errorf("got %d goroutines, expect at most %d", got, before)
+	}
+}
+
+func TestCloseWhileSending(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	var apn *Apn
+	apn = newTestApn(t, s, time.Second, WithTokenFilter(func(token string) bool {
+		if token == testToken(0x02) {
+			apn.Close()
+		}
+		return true
+	}))
+	if err := apn.Send(testNotification(testToken(0x01), "hello")); err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+	<-s.frames
+	if got := apn.Send(testNotification(testToken(0x02), "hello")); !errors.Is(got, ErrClosed) {
+		t.Errorf("got: %v, expect: %s", got, ErrClosed)
+	}
+}
+
+func TestActiveWorkers(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	apn := newTestApn(t, s, time.Second)
+	go func() {
+		for range s.frames {
+		}
+	}()
+
+	// a sending goroutine and one reading the connection, however many send
+	var wg sync.WaitGroup
+	most := int32(0)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				apn.Send(testNotification(testToken(byte(i)), "hello"))
+				if n := int32(apn.ActiveWorkers()); n > atomic.LoadInt32(&most) {
+					atomic.StoreInt32(&most, n)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if got := atomic.LoadInt32(&most); got > 2 {
+		t.Errorf("got %d workers, expect at most 2", got)
+	}
+
+	// a Broadcast adds its shards, and each extra connection's sending,
+	// reading and error forwarding goroutines
+	before := apn.ActiveWorkers()
+	var tokens []string
+	for i := 0; i < 200; i++ {
+		tokens = append(tokens, testToken(byte(i)))
+	}
+	payload := &Payload{}
+	payload.Aps.AlertString = "hello"
+	most = 0
+	for range apn.Broadcast(tokens, payload, BroadcastOptions{Concurrency: 4}) {
+		if n := int32(apn.ActiveWorkers()); n > most {
+			most = n
+		}
+	}
+	if most < 12 {
+		t.Errorf("got at most %d workers during a Broadcast, expect 12 or more", most)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for apn.ActiveWorkers() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d workers after a Broadcast, expect %d", apn.ActiveWorkers(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	apn.Close()
+	deadline = time.Now().Add(2 * time.Second)
+	for apn.ActiveWorkers() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d workers after Close", apn.ActiveWorkers())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCloseDuringConcurrentSends(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	go func() {
+		for range s.frames {
+		}
+	}()
+	apn := newTestApn(t, s, time.Second)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				err := apn.Send(testNotification(testToken(byte(i)), "hello"))
+				if err != nil && !errors.Is(err, ErrClosed) && !errors.Is(err, ErrNotConnected) {
+					t.Errorf("got: %s, expect no error or %s", err, ErrClosed)
+					return
+				}
+			}
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond)
+	apn.Close()
+	wg.Wait()
+}
+
+func TestDialTimeoutCoversHandshake(t *testing.T) {
+	// accepts TCP connections but never answers the TLS handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("can't listen: %s", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	certPEM, keyPEM := testCertificate(t)
+	apn, err := NewWithOptions(certPEM, keyPEM, listener.Addr().String(), WithDialTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("can't create apn: %s", err)
+	}
+	defer apn.Close()
+
+	start := time.Now()
+	if err := apn.Send(testNotification(testToken(0x01), "hello")); err == nil {
+		t.Errorf("send should time out")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("took %s to time out", elapsed)
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	// accepts TCP connections but never answers the TLS handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("can't listen: %s", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	certPEM, keyPEM := testCertificate(t)
+
+	for _, c := range []struct {
+		opt    Option
+		expect bool
+	}{
+		{WithHandshakeTimeout(100 * time.Millisecond), true},
+		{WithDialTimeout(100 * time.Millisecond), false},
+	} {
+		apn, err := NewWithOptions(certPEM, keyPEM, listener.Addr().String(), WithDialTimeout(time.Minute), c.opt)
+		if err != nil {
+			t.Fatalf("can't create apn: %s", err)
+		}
+		start := time.Now()
+		err = apn.Reconnect()
+		apn.Close()
+		if err == nil {
+			t.Fatalf("connect should time out")
+		}
+		if got := errors.Is(err, ErrHandshakeTimeout); got != c.expect {
+			t.Errorf("got: %s, expect handshake timeout: %t", err, c.expect)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("took %s to time out", elapsed)
+		}
+	}
+}
+
+func TestLastError(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	apn := newTestApn(t, s, time.Second)
+	defer apn.Close()
+
+	if err := apn.LastError(); err != nil {
+		t.Errorf("got: %s, expect no error", err)
+	}
+	if got, expect := apn.Send(testNotification("0102", "hello")), ErrInvalidTokenSize; got != expect {
+		t.Errorf("got: %v, expect: %s", got, expect)
+	}
+	if got, expect := apn.LastError(), ErrInvalidTokenSize; got != expect {
+		t.Errorf("got: %v, expect: %s", got, expect)
+	}
+	if err := apn.Reconnect(); err != nil {
+		t.Fatalf("reconnect error: %s", err)
+	}
+	if err := apn.LastError(); err != nil {
+		t.Errorf("got: %s, expect no error after reconnecting", err)
+	}
+}
+
+func TestNotificationClone(t *testing.T) {
+	n := testNotification(testToken(0x01), "hello")
+	n.Payload.SetCustom("acme", 1)
+	n.Payload.Aps.AlertDictionary = &AlertDictionary{LockKey: "KEY", LockArgs: []string{"Jenna"}}
+	n.RawPayload = []byte(`{"aps":{}}`)
+
+	c := n.Clone()
+	c.DeviceToken = testToken(0x02)
+	c.Payload.Aps.AlertString = "bye"
+	c.Payload.SetCustom("acme", 2)
+	c.Payload.Aps.AlertDictionary.LockArgs[0] = "Frank"
+	c.RawPayload[2] = 'x'
+
+	if n.DeviceToken != testToken(0x01) || n.Payload.Aps.AlertString != "hello" {
+		t.Errorf("changing the clone changed the original: %+v", n)
+	}
+	if got := n.Payload.GetCustom("acme"); got != 1 {
+		t.Errorf("got custom: %v, expect: 1", got)
+	}
+	if got := n.Payload.Aps.AlertDictionary.LockArgs[0]; got != "Jenna" {
+		t.Errorf("got loc-args: %s, expect: Jenna", got)
+	}
+	if got := string(n.RawPayload); got != `{"aps":{}}` {
+		t.Errorf("got raw payload: %s", got)
+	}
+}
+
+func TestSendMulti(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	apn := newTestApn(t, s, time.Second)
+	defer apn.Close()
+
+	tokens := []string{testToken(0x01), "0102", testToken(0x03)}
+	results := apn.SendMulti(testNotification("", "hello"), tokens)
+	for i, r := range results {
+		if r.Token != tokens[i] {
+			t.Errorf("got: %s, expect: %s", r.Token, tokens[i])
+		}
+	}
+	if results[0].Err != nil || results[2].Err != nil {
+		t.Errorf("send errors: %v, %v", results[0].Err, results[2].Err)
+	}
+	if results[1].Err != ErrInvalidTokenSize {
+		t.Errorf("got: %v, expect: %s", results[1].Err, ErrInvalidTokenSize)
+	}
+	if results[0].Identifier == results[2].Identifier {
+		t.Errorf("got identifier %d twice", results[0].Identifier)
+	}
+	for _, r := range []SendResult{results[0], results[2]} {
+		f := <-s.frames
+		if f.token != r.Token || f.identifier != r.Identifier {
+			t.Errorf("got: %s id(%d), expect: %s id(%d)", f.token, f.identifier, r.Token, r.Identifier)
+		}
+	}
+
+	for _, r := range apn.SendMulti(nil, tokens) {
+		if r.Err != ErrNilNotification {
+			t.Errorf("%s: got: %v, expect: %s", r.Token, r.Err, ErrNilNotification)
+		}
+	}
+}
+
+func TestSendMultiBadge(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	apn := newTestApn(t, s, time.Second)
+	defer apn.Close()
+	tokens := []string{testToken(0x01), testToken(0x02)}
+
+	// Badge 0 leaves every recipient's badge untouched.
+	for _, r := range apn.SendMulti(testNotification("", "hello"), tokens) {
+		if r.Err != nil {
+			t.Fatalf("send error: %s", r.Err)
+		}
+		if got, expect := (<-s.frames).payload, `{"aps":{"alert":"hello"}}`; got != expect {
+			t.Errorf("got: %s, expect: %s", got, expect)
+		}
+	}
+
+	n := testNotification("", "hello")
+	n.Payload.Aps.Badge = 3
+	for _, r := range apn.SendMulti(n, tokens) {
+		if r.Err != nil {
+			t.Fatalf("send error: %s", r.Err)
+		}
+		if got, expect := (<-s.frames).payload, `{"aps":{"alert":"hello","badge":3}}`; got != expect {
+			t.Errorf("got: %s, expect: %s", got, expect)
+		}
+	}
+}
+
+func TestReadErrorConnectionRefused(t *testing.T) {
+	{
+		apn := &Apn{errorChan: make(chan error, 1), generation: 1}
+		client, server := net.Pipe()
+		quit := make(chan *NotificationError, 1)
+		go readError(apn, client, 1, quit)
+
+		server.Close()
+		if got := <-apn.errorChan; !errors.Is(got, ErrConnectionRefusedByApple) {
+			t.Errorf("got: %s, expect: %s", got, ErrConnectionRefusedByApple)
+		}
+	}
+
+	{
+		apn := &Apn{errorChan: make(chan error, 2), generation: 1}
+		client, server := net.Pipe()
+		quit := make(chan *NotificationError, 1)
+		go readError(apn, client, 1, quit)
+
+		// a close after an answer isn't a refusal, nor reported at all
+		server.Write([]byte{8, 8, 0, 0, 0, 1})
+		server.Close()
+		<-quit
+		if got := <-apn.errorChan; errors.Is(got, ErrConnectionRefusedByApple) {
+			t.Errorf("got: %s, expect the error response", got)
+		}
+		if got := len(apn.errorChan); got != 0 {
+			t.Errorf("got %d more errors, expect 0", got)
+		}
+	}
+}
+
+func TestNotificationWriteTo(t *testing.T) {
+	n := testNotification(testToken(0x01), "hello")
+	n.ExpiryUnix = 0x5f5e1000
+	var buf bytes.Buffer
+	written, err := n.WriteTo(&buf, 7)
+	if err != nil {
+		t.Fatalf("write error: %s", err)
+	}
+	token, payload, _ := n.validate(maxPayloadBytes)
+	if expect := encodeEnhanced(7, 0x5f5e1000, token, payload); !bytes.Equal(buf.Bytes(), expect) || written != int64(len(expect)) {
+		t.Errorf("got: %x (%d bytes), expect: %x", buf.Bytes(), written, expect)
+	}
+
+	// the frame Apple gets
+	s := newTestServer(t, nil)
+	defer s.Close()
+	apn := newTestApn(t, s, time.Second)
+	defer apn.Close()
+	id, err := apn.SendID(n)
+	if err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+	buf.Reset()
+	n.WriteTo(&buf, id)
+	if got, expect := (<-s.frames), mustReadTestFrame(t, &buf); got != expect {
+		t.Errorf("got: %+v, expect: %+v", got, expect)
+	}
+
+	if _, err := (&Notification{DeviceToken: "bad"}).WriteTo(&buf, 1); err == nil {
+		t.Errorf("wrote an invalid notification")
+	}
+}
+
+func mustReadTestFrame(t *testing.T, r io.Reader) testFrame {
+	t.Helper()
+	f, err := readTestFrame(r)
+	if err != nil {
+		t.Fatalf("can't read frame: %s", err)
+	}
+	return f
+}
+
+func TestEncodeFramed(t *testing.T) {
+	token := bytes.Repeat([]byte{0xaa}, 32)
+	payload := []byte(`{"aps":{}}`)
+
+	expect := []byte{2, 0, 0, 0, 66}
+	expect = append(expect, 1, 0, 32)
+	expect = append(expect, token...)
+	expect = append(expect, 2, 0, 10)
+	expect = append(expect, payload...)
+	expect = append(expect, 3, 0, 4, 0, 0, 0, 7)
+	expect = append(expect, 4, 0, 4, 0x5f, 0x5e, 0x10, 0x00)
+	expect = append(expect, 5, 0, 1, 5)
+	if got := encodeFramed(7, 0x5f5e1000, token, payload, 5); !bytes.Equal(got, expect) {
+		t.Errorf("got: %x, expect: %x", got, expect)
+	}
+
+	// no priority item
+	expect = expect[:len(expect)-4]
+	expect[4] = 62
+	if got := encodeFramed(7, 0x5f5e1000, token, payload, 0); !bytes.Equal(got, expect) {
+		t.Errorf("got: %x, expect: %x", got, expect)
+	}
+}
+
+func TestFramedFormat(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	apn := newTestApn(t, s, time.Second, WithFramedFormat())
+	defer apn.Close()
+
+	n := testNotification(testToken(0x01), "hello")
+	n.Priority = 5
+	identifier, err := apn.SendID(n)
+	if err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+	f := <-s.frames
+	if f.command != 2 || f.priority != 5 || f.identifier != identifier || f.token != n.DeviceToken || f.payload != `{"aps":{"alert":"hello"}}` {
+		t.Errorf("got: %+v", f)
+	}
+}
+
+func TestSetIdleTimeout(t *testing.T) {
+	burst := func(hint bool) int32 {
+		s := newTestServer(t, nil)
+		defer s.Close()
+		apn := newTestApn(t, s, 50*time.Millisecond)
+		defer apn.Close()
+		if hint {
+			apn.SetIdleTimeout(time.Minute)
+		}
+		for i := 0; i < 2; i++ {
+			if err := apn.Send(testNotification(testToken(0x01), "hello")); err != nil {
+				t.Fatalf("send error: %s", err)
+			}
+			<-s.frames
+			time.Sleep(150 * time.Millisecond)
+		}
+		return atomic.LoadInt32(&s.accepted)
+	}
+
+	if got := burst(false); got != 2 {
+		t.Errorf("without hint got: %d connections, expect: 2", got)
+	}
+	if got := burst(true); got != 1 {
+		t.Errorf("with hint got: %d connections, expect: 1", got)
+	}
+}
+
+func TestNewFromCombinedPEM(t *testing.T) {
+	certPEM, keyPEM := testCertificate(t)
+
+	for _, bundle := range [][]byte{
+		append(append([]byte{}, certPEM...), keyPEM...),
+		append(append([]byte{}, keyPEM...), certPEM...),
+	} {
+		apn, err := NewFromCombinedPEM(bundle, "127.0.0.1:0", 0)
+		if err != nil {
+			t.Fatalf("new error: %s", err)
+		}
+		apn.Close()
+	}
+
+	{
+		_, err := NewFromCombinedPEM(keyPEM, "127.0.0.1:0", 0)
+		if got, expect := err, ErrNoCertificateInPEM; got != expect {
+			t.Errorf("got: %v, expect: %v", got, expect)
+		}
+	}
+
+	{
+		_, err := NewFromCombinedPEM(certPEM, "127.0.0.1:0", 0)
+		if got, expect := err, ErrNoPrivateKeyInPEM; got != expect {
+			t.Errorf("got: %v, expect: %v", got, expect)
+		}
+	}
+}
+
+func TestKeyPairErrors(t *testing.T) {
+	certPEM, keyPEM := testCertificate(t)
+	_, otherKeyPEM := testCertificateNamed(t, "other")
+
+	for _, c := range []struct {
+		cert, key []byte
+		expect    error
+	}{
+		{certPEM, otherKeyPEM, ErrCertKeyMismatch},
+		{keyPEM, keyPEM, ErrNoCertificateInPEM},
+		{certPEM, certPEM, ErrNoPrivateKeyInPEM},
+		{nil, keyPEM, ErrNoCertificateInPEM},
+	} {
+		if _, got := NewWithOptions(c.cert, c.key, "127.0.0.1:0"); got != c.expect {
+			t.Errorf("got: %v, expect: %s", got, c.expect)
+		}
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	apn := newTestApn(t, s, time.Second)
+	defer apn.Close()
+
+	{
+		n := testNotification(testToken(0x01), "hello")
+		n.ExpiryUnix = 1700000000
+		n.ExpireAfterSeconds = 60
+		if err := apn.Send(n); err != nil {
+			t.Fatalf("send error: %s", err)
+		}
+		if got, expect := (<-s.frames).expiry, uint32(1700000000); got != expect {
+			t.Errorf("got: %d, expect: %d", got, expect)
+		}
+	}
+
+	{
+		n := testNotification(testToken(0x01), "hello")
+		n.ExpireAfterSeconds = 60
+		before := time.Now().Add(time.Minute).Unix()
+		if err := apn.Send(n); err != nil {
+			t.Fatalf("send error: %s", err)
+		}
+		after := time.Now().Add(time.Minute).Unix()
+		if got := int64((<-s.frames).expiry); got < before || got > after {
+			t.Errorf("got: %d, expect between %d and %d", got, before, after)
+		}
+	}
+}
+
+func TestBackgroundExpiry(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	logger := testLogger{make(chan string, 10)}
+	apn := newTestApn(t, s, time.Second, WithBackgroundExpiry(time.Hour), WithLogger(logger))
+	defer apn.Close()
+
+	background := func() *Notification {
+		return &Notification{DeviceToken: testToken(0x01), Payload: &Payload{Aps: Aps{ContentAvailable: true}}}
+	}
+	own := background()
+	own.ExpireAfterSeconds = 60
+	// an alert push, not a background one
+	hybrid := background()
+	hybrid.Payload.Aps.AlertString = "hello"
+	// still a background push
+	badge := background()
+	badge.Payload.Aps.Badge = 3
+	for _, c := range []struct {
+		n      *Notification
+		expect time.Duration
+	}{
+		{background(), time.Hour},
+		{own, time.Minute},
+		{testNotification(testToken(0x01), "hello"), 0},
+		{hybrid, 0},
+		{badge, time.Hour},
+	} {
+		before := time.Now().Add(c.expect).Unix()
+		if err := apn.Send(c.n); err != nil {
+			t.Fatalf("send error: %s", err)
+		}
+		after := time.Now().Add(c.expect).Unix()
+		if got := int64((<-s.frames).expiry); got < before || got > after {
+			t.Errorf("got: %d, expect between %d and %d", got, before, after)
+		}
+	}
+	for {
+		select {
+		case line := <-logger.lines:
+			if strings.Contains(line, "content-available but alerts") {
+				return
+			}
+		default:
+			t.Fatalf("hybrid payload not logged")
+		}
+	}
+}
+
+func TestPing(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+
+	{
+		apn := newTestApn(t, s, time.Second)
+		if err := apn.Ping(context.Background()); err != nil {
+			t.Errorf("ping error: %s", err)
+		}
+		if got := apn.PeerCertificates(); got != nil {
+			t.Errorf("ping shouldn't keep a connection")
+		}
+		apn.Close()
+	}
+
+	{
+		// The server's certificate isn't trusted without the test's RootCAs.
+		apn, err := NewWithOptions(s.certPEM, s.keyPEM, s.listener.Addr().String())
+		if err != nil {
+			t.Fatalf("can't create apn: %s", err)
+		}
+		if err := apn.Ping(context.Background()); err == nil {
+			t.Errorf("ping with an untrusted server certificate should fail")
+		}
+		apn.Close()
+	}
+}
+
+func TestSendWithResultReconnected(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	apn := newTestApn(t, s, time.Second)
+	defer apn.Close()
+
+	send := func() bool {
+		r := apn.SendWithResult(testNotification(testToken(0x01), "hello"))
+		if r.Err != nil {
+			t.Fatalf("send error: %s", r.Err)
+		}
+		<-s.frames
+		return r.Reconnected
+	}
+
+	if !send() {
+		t.Errorf("first send should connect")
+	}
+	if send() {
+		t.Errorf("second send should reuse the connection")
+	}
+	if err := apn.Reconnect(); err != nil {
+		t.Fatalf("reconnect error: %s", err)
+	}
+	if send() {
+		t.Errorf("send after Reconnect uses the connection Reconnect made")
+	}
+}
+
+func TestReadErrorNoErrorsStatus(t *testing.T) {
+	apn := &Apn{errorChan: make(chan error, 2), generation: 1}
+	client, server := net.Pipe()
+	quit := make(chan *NotificationError, 1)
+	go readError(apn, client, 1, quit)
+
+	server.Write([]byte{8, 0, 0, 0, 0, 1})
+	server.Close()
+	if got := <-apn.errorChan; !errors.Is(got, io.EOF) {
+		t.Errorf("got: %s, expect: %s", got, io.EOF)
+	}
+	if last := <-quit; last != nil {
+		t.Errorf("got: %s, expect no error response", last)
+	}
+	if got := apn.Stats().StatusCounts[0]; got != 0 {
+		t.Errorf("status 0 counted %d times", got)
+	}
+}
+
+func TestReadErrorSuppressesTrailingEOF(t *testing.T) {
+	apn := &Apn{errorChan: make(chan error, 2), generation: 1}
+	client, server := net.Pipe()
+	quit := make(chan *NotificationError, 1)
+	go readError(apn, client, 1, quit)
+
+	server.Write([]byte{8, 8, 0, 0, 0, 1})
+	server.Close()
+	last := <-quit
+	if last == nil || last.Status != 8 {
+		t.Fatalf("got: %v, expect the error response", last)
+	}
+	if got := len(apn.errorChan); got != 1 {
+		t.Fatalf("got %d errors, expect 1", got)
+	}
+	if got := (<-apn.errorChan).(NotificationError); got.Status != 8 || got.Identifier != 1 {
+		t.Errorf("got: %s, expect the error response", got)
+	}
+}
+
+func TestServerName(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	_, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(s.certPEM)
+
+	{
+		// The certificate is for 127.0.0.1, not localhost.
+		apn, err := NewWithOptions(s.certPEM, s.keyPEM, "localhost:"+port)
+		if err != nil {
+			t.Fatalf("can't create apn: %s", err)
+		}
+		apn.conf.RootCAs = pool
+		if err := apn.Ping(context.Background()); err == nil {
+			t.Errorf("ping should fail verifying localhost")
+		}
+		apn.Close()
+	}
+
+	{
+		apn, err := NewWithOptions(s.certPEM, s.keyPEM, "localhost:"+port, WithServerName("127.0.0.1"))
+		if err != nil {
+			t.Fatalf("can't create apn: %s", err)
+		}
+		apn.conf.RootCAs = pool
+		if err := apn.Ping(context.Background()); err != nil {
+			t.Errorf("ping error: %s", err)
+		}
+		apn.Close()
+	}
+}
+
+func TestLocalErrorIdentifier(t *testing.T) {
+	client, server := net.Pipe()
+	server.Close()
+	apn := &Apn{
+		errorChan:       make(chan error, 1),
+		maxPayloadBytes: maxPayloadBytes,
+		conn:            tls.Client(client, &tls.Config{}),
+		identifier:      7,
+	}
+
+	// A resend has nobody waiting, so the write error goes to ErrorChan.
+	apn.deliver(&sendArg{n: testNotification(testToken(0x01), "hello")})
+	e, ok := (<-apn.errorChan).(NotificationError)
+	if !ok || e.OtherError == nil {
+		t.Fatalf("got: %v, expect a write error", e)
+	}
+	if e.Identifier != 7 {
+		t.Errorf("got identifier: %d, expect: 7", e.Identifier)
+	}
+}
+
+func TestMaxInFlight(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	apn := newTestApn(t, s, 0, WithMaxInFlight(2))
+	defer apn.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := apn.Send(testNotification(testToken(0x01), "hello")); err != nil {
+			t.Fatalf("send error: %s", err)
+		}
+	}
+	if got, expect := apn.Send(testNotification(testToken(0x01), "hello")), ErrInFlightFull; got != expect {
+		t.Errorf("got: %v, expect: %s", got, expect)
+	}
+
+	if err := apn.Reconnect(); err != nil {
+		t.Fatalf("reconnect error: %s", err)
+	}
+	if err := apn.Send(testNotification(testToken(0x01), "hello")); err != nil {
+		t.Errorf("send after reconnect error: %s", err)
+	}
+}
+
+func TestLastSuccessfulSend(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	apn := newTestApn(t, s, time.Second)
+	defer apn.Close()
+
+	if got := apn.LastSuccessfulSend(); !got.IsZero() {
+		t.Errorf("got: %s before any send", got)
+	}
+	before := time.Now()
+	if err := apn.Send(testNotification(testToken(0x01), "hello")); err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+	if got := apn.LastSuccessfulSend(); got.Before(before) || got.After(time.Now()) {
+		t.Errorf("got: %s, expect after %s", got, before)
+	}
+
+	last := apn.LastSuccessfulSend()
+	if err := apn.Send(testNotification("0102", "hello")); err == nil {
+		t.Fatalf("send with an invalid token should fail")
+	}
+	if got := apn.LastSuccessfulSend(); !got.Equal(last) {
+		t.Errorf("failed send changed it from %s to %s", last, got)
+	}
+}
+
+func TestCertificateExpiry(t *testing.T) {
+	{
+		certPEM, keyPEM := testCertificateExpiring(t, "127.0.0.1", time.Now().Add(-time.Hour))
+		_, err := NewWithOptions(certPEM, keyPEM, "127.0.0.1:0")
+		if !errors.Is(err, ErrCertificateExpired) {
+			t.Errorf("got: %v, expect: %s", err, ErrCertificateExpired)
+		}
+	}
+
+	{
+		certPEM, keyPEM := testCertificateExpiring(t, "127.0.0.1", time.Now().Add(7*24*time.Hour))
+		logger := testLogger{make(chan string, 10)}
+		apn, err := NewWithOptions(certPEM, keyPEM, "127.0.0.1:0", WithLogger(logger))
+		if err != nil {
+			t.Fatalf("can't create apn: %s", err)
+		}
+		apn.Close()
+		select {
+		case got := <-logger.lines:
+			if !strings.HasPrefix(got, "certificate expires soon") {
+				t.Errorf("got: %s, expect an expiry warning", got)
+			}
+		default:
+			t.Errorf("no expiry warning")
+		}
+	}
+}
+
+func TestProtocolCommand(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+
+	for _, command := range []uint8{CommandEnhanced, CommandFramed} {
+		apn := newTestApn(t, s, time.Second, WithProtocolCommand(command))
+		if err := apn.Send(testNotification(testToken(0x01), "hello")); err != nil {
+			t.Fatalf("send error: %s", err)
+		}
+		if got := (<-s.frames).command; got != command {
+			t.Errorf("got command: %d, expect: %d", got, command)
+		}
+		apn.Close()
+	}
+
+	_, err := NewWithOptions(s.certPEM, s.keyPEM, "127.0.0.1:0", WithProtocolCommand(3))
+	if err != ErrUnsupportedCommand {
+		t.Errorf("got: %v, expect: %s", err, ErrUnsupportedCommand)
+	}
+}
+
+func TestEagerConnect(t *testing.T) {
+	s := newTestServer(t, nil)
+	addr := s.listener.Addr().String()
+	s.Close()
+
+	start := time.Now()
+	apn, err := NewWithOptions(s.certPEM, s.keyPEM, addr, WithEagerConnect())
+	if err == nil {
+		apn.Close()
+		t.Fatalf("eager connect to a closed port should fail")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("took %s to fail", elapsed)
+	}
+
+	// lazy by default
+	apn, err = NewWithOptions(s.certPEM, s.keyPEM, addr)
+	if err != nil {
+		t.Fatalf("lazy connect error: %s", err)
+	}
+	apn.Close()
+}
+
+// A net.Conn counting its writes.
+type countingConn struct {
+	net.Conn
+	writes int32
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	atomic.AddInt32(&c.writes, 1)
+	return c.Conn.Write(p)
+}
+
+func newCountingApn(t testing.TB, s *testServer, opts ...Option) (*Apn, *countingConn) {
+	conn := make(chan *countingConn, 1)
+	opts = append(opts, WithDialFunc(func(network, addr string) (net.Conn, error) {
+		client, server := net.Pipe()
+		go s.serve(tls.Server(server, s.conf))
+		c := &countingConn{Conn: client}
+		conn <- c
+		return c, nil
+	}))
+	apn, err := NewWithOptions(s.certPEM, s.keyPEM, s.listener.Addr().String(), opts...)
+	if err != nil {
+		t.Fatalf("can't create apn: %s", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(s.certPEM)
+	apn.conf.RootCAs = pool
+	if err := apn.Reconnect(); err != nil {
+		t.Fatalf("connect error: %s", err)
+	}
+	c := <-conn
+	atomic.StoreInt32(&c.writes, 0)
+	return apn, c
+}
+
+// Blocks writes once stall is closed until the write deadline, like a
+// connection the network no longer carries data on.
+type stallConn struct {
+	net.Conn
+	stall    chan struct{}
+	deadline atomic.Value // time.Time
+	timedOut int32
+}
+
+func (c *stallConn) SetWriteDeadline(t time.Time) error {
+	c.deadline.Store(t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *stallConn) Write(p []byte) (int, error) {
+	select {
+	case <-c.stall:
+		deadline, _ := c.deadline.Load().(time.Time)
+		if deadline.IsZero() {
+			select {}
+		}
+		// only the first write waits, so tls's close_notify doesn't
+		if atomic.AddInt32(&c.timedOut, 1) == 1 {
+			time.Sleep(time.Until(deadline))
+		}
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+	return c.Conn.Write(p)
+}
+
+func TestWriteTimeout(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	stall := make(chan struct{})
+	dials := int32(0)
+	apn := newTestApn(t, s, 0, WithWriteTimeout(100*time.Millisecond), WithDialFunc(func(network, addr string) (net.Conn, error) {
+		client, server := net.Pipe()
+		go s.serve(tls.Server(server, s.conf))
+		if atomic.AddInt32(&dials, 1) == 1 {
+			return &stallConn{Conn: client, stall: stall}, nil
+		}
+		return client, nil
+	}))
+	defer apn.Close()
+	go func() {
+		for range apn.ErrorChan {
+		}
+	}()
+	if err := apn.Reconnect(); err != nil {
+		t.Fatalf("connect error: %s", err)
+	}
+
+	close(stall)
+	if err := apn.Send(testNotification(testToken(0x01), "hello")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("got: %v, expect: %s", err, os.ErrDeadlineExceeded)
+	}
+	if err := apn.Send(testNotification(testToken(0x02), "hello")); err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+	select {
+	case f := <-s.frames:
+		if f.token != testToken(0x02) {
+			t.Errorf("got: %s, expect: %s", f.token, testToken(0x02))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("not sent on a new connection")
+	}
+	if got := atomic.LoadInt32(&dials); got != 2 {
+		t.Errorf("got %d dials, expect 2", got)
+	}
+}
+
+func TestIdleGrace(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	go func() {
+		for range s.frames {
+		}
+	}()
+
+	for _, c := range []struct {
+		grace  time.Duration
+		expect uint64
+	}{
+		{0, 4},
+		{200 * time.Millisecond, 1},
+	} {
+		apn := newTestApn(t, s, 50*time.Millisecond, WithIdleGrace(c.grace))
+		for i := 0; i < 4; i++ {
+			if err := apn.Send(testNotification(testToken(0x01), "hello")); err != nil {
+				t.Fatalf("send error: %s", err)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if got := apn.Stats().Reconnects; got != c.expect {
+			t.Errorf("grace %s: got %d connections, expect: %d", c.grace, got, c.expect)
+		}
+		// closing an idle connection isn't Apple refusing it
+		select {
+		case err := <-apn.ErrorChan:
+			t.Errorf("grace %s: got error: %s", c.grace, err)
+		default:
+		}
+		apn.Close()
+	}
+}
+
+func TestWriteBuffer(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	apn, conn := newCountingApn(t, s, WithWriteBufferSize(4096), WithFlushInterval(50*time.Millisecond))
+	defer apn.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := apn.Send(testNotification(testToken(0x01), "hello")); err != nil {
+			t.Fatalf("send error: %s", err)
+		}
+	}
+	if got := atomic.LoadInt32(&conn.writes); got != 0 {
+		t.Errorf("got %d writes before the flush interval, expect 0", got)
+	}
+	for i := 0; i < 10; i++ {
+		select {
+		case <-s.frames:
+		case <-time.After(time.Second):
+			t.Fatalf("got %d frames, expect 10", i)
+		}
+	}
+	if got := atomic.LoadInt32(&conn.writes); got != 1 {
+		t.Errorf("got %d writes, expect 1", got)
+	}
+}
+
+func TestWriteBufferFlushErrorOnClose(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	apn, conn := newCountingApn(t, s, WithWriteBufferSize(4096), WithFlushInterval(time.Hour), WithTimeout(100*time.Millisecond))
+	defer apn.Close()
+
+	if err := apn.Send(testNotification(testToken(0x01), "hello")); err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+	conn.Conn.Close()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case err := <-apn.ErrorChan:
+			if strings.Contains(err.Error(), "flush socket error") {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("flush error on close not reported")
+		}
+	}
+}
+
+func BenchmarkWriteBuffer(b *testing.B) {
+	s := newTestServer(b, nil)
+	defer s.Close()
+	go func() {
+		for range s.frames {
+		}
+	}()
+
+	for _, c := range []struct {
+		name string
+		opts []Option
+	}{
+		{"unbuffered", nil},
+		{"buffered", []Option{WithWriteBufferSize(16 * 1024), WithFlushInterval(10 * time.Millisecond)}},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			apn, conn := newCountingApn(b, s, c.opts...)
+			defer apn.Close()
+			n := testNotification(testToken(0x01), "hello")
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := apn.Send(n); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(atomic.LoadInt32(&conn.writes))/float64(b.N), "writes/op")
+		})
+	}
+}
+
+func TestOnConnect(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	states := make(chan tls.ConnectionState, 2)
+	apn := newTestApn(t, s, time.Second, WithOnConnect(func(state tls.ConnectionState) {
+		states <- state
+	}))
+	defer apn.Close()
+
+	if err := apn.Send(testNotification(testToken(0x01), "hello")); err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+	if err := apn.Reconnect(); err != nil {
+		t.Fatalf("reconnect error: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case state := <-states:
+			if !state.HandshakeComplete {
+				t.Errorf("connect %d: handshake not complete", i+1)
+			}
+		default:
+			t.Fatalf("got %d connect callbacks, expect 2", i)
+		}
+	}
+}
+
+func TestMaxQueueAge(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	atomic.StoreInt64(&s.handshakeDelay, int64(300*time.Millisecond))
+	apn := newTestApn(t, s, time.Second, WithMaxQueueAge(100*time.Millisecond))
+	defer apn.Close()
+
+	first := make(chan error, 1)
+	go func() {
+		first <- apn.Send(testNotification(testToken(0x01), "first"))
+	}()
+	time.Sleep(50 * time.Millisecond)
+	// waits for the first one's connect
+	if got, expect := apn.Send(testNotification(testToken(0x02), "second")), ErrStale; got != expect {
+		t.Errorf("got: %v, expect: %s", got, expect)
+	}
+	if err := <-first; err != nil {
+		t.Errorf("first send error: %s", err)
+	}
+	if err := apn.Send(testNotification(testToken(0x03), "third")); err != nil {
+		t.Errorf("third send error: %s", err)
+	}
+}
+
+func TestOnDropped(t *testing.T) {
+	type drop struct {
+		token  string
+		reason error
+	}
+	drops := make(chan drop, 10)
+	onDropped := func(n *Notification, reason error) {
+		drops <- drop{n.DeviceToken, reason}
+	}
+	expect := func(token string, check func(error) bool) {
+		t.Helper()
+		select {
+		case d := <-drops:
+			if d.token != token || !check(d.reason) {
+				t.Errorf("got drop of %s: %v", d.token, d.reason)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s not dropped", token)
+		}
+	}
+
+	{
+		apn := &Apn{maxPayloadBytes: maxPayloadBytes, dryRun: true, onDropped: onDropped, tokenFilter: func(string) bool { return false }}
+		apn.send(testNotification(testToken(0x01), "hello"))
+		expect(testToken(0x01), func(err error) bool { return err == ErrTokenFiltered })
+	}
+
+	{
+		apn := &Apn{maxPayloadBytes: maxPayloadBytes, maxInFlight: 1, onDropped: onDropped}
+		apn.inflight = []inFlight{{identifier: 0, notification: testNotification(testToken(0x01), "first"), expiry: 0}}
+		apn.send(testNotification(testToken(0x02), "hello"))
+		expect(testToken(0x02), func(err error) bool { return err == ErrInFlightFull })
+	}
+
+	{
+		bad := testNotification(testToken(0x03), "bad")
+		apn := &Apn{inflight: []inFlight{{identifier: 1, notification: bad, expiry: 0}}, onDropped: onDropped}
+		apn.requeue(&NotificationError{Command: 8, Status: 8, Identifier: 1})
+		expect(testToken(0x03), func(err error) bool {
+			e, ok := err.(NotificationError)
+			return ok && e.Status == 8
+		})
+		// Apple delivered the one a shutdown names
+		apn.requeue(&NotificationError{Command: 8, Status: 10, Identifier: 1})
+		select {
+		case d := <-drops:
+			t.Errorf("got drop after shutdown: %v", d)
+		default:
+		}
+	}
+
+	{
+		s := newTestServer(t, nil)
+		defer s.Close()
+		atomic.StoreInt64(&s.handshakeDelay, int64(300*time.Millisecond))
+		apn := newTestApn(t, s, time.Second, WithMaxQueueAge(100*time.Millisecond), WithOnDropped(onDropped))
+		defer apn.Close()
+		go apn.Send(testNotification(testToken(0x04), "first"))
+		time.Sleep(50 * time.Millisecond)
+		apn.Send(testNotification(testToken(0x05), "second"))
+		expect(testToken(0x05), func(err error) bool { return err == ErrStale })
+	}
+}
+
+func TestDeadLetterChan(t *testing.T) {
+	bad := testToken(0xbb)
+	s := newTestServer(t, func(f testFrame) uint8 {
+		if f.token == bad {
+			return statusInvalidToken
+		}
+		return 0
+	})
+	defer s.Close()
+	apn := newTestApn(t, s, time.Second, WithDeadLetterChan(1))
+	defer apn.Close()
+	go func() {
+		for range apn.ErrorChan {
+		}
+	}()
+
+	n := testNotification(bad, "hello")
+	if err := apn.Send(n); err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+	select {
+	case d := <-apn.DeadLetterChan:
+		if d.Notification != n || d.Status != statusInvalidToken {
+			t.Errorf("got dead letter %s status %d", d.Notification.DeviceToken, d.Status)
+		}
+		if e, ok := d.Reason.(NotificationError); !ok || e.Status != statusInvalidToken {
+			t.Errorf("got reason %v", d.Reason)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no dead letter")
+	}
+	select {
+	case f := <-s.frames:
+		t.Errorf("got resent %s", f.token)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	// nil unless asked for
+	plain := newTestApn(t, s, time.Second)
+	defer plain.Close()
+	if plain.DeadLetterChan != nil {
+		t.Errorf("got a DeadLetterChan without WithDeadLetterChan")
+	}
+}
+
+func TestTokenRedaction(t *testing.T) {
+	bad := testToken(0xbb)
+	s := newTestServer(t, func(f testFrame) uint8 {
+		return statusInvalidToken
+	})
+	defer s.Close()
+	apn := newTestApn(t, s, time.Second, WithTokenRedaction(4))
+	defer apn.Close()
+
+	if err := apn.Send(testNotification(bad, "hello")); err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+	select {
+	case err := <-apn.ErrorChan:
+		e, ok := err.(NotificationError)
+		if !ok {
+			t.Fatalf("got error %v", err)
+		}
+		if got, expect := e.DeviceToken(), "..."+bad[len(bad)-4:]; got != expect {
+			t.Errorf("got: %s, expect: %s", got, expect)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no error")
+	}
+}
+
+func TestAbort(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	atomic.StoreInt64(&s.handshakeDelay, int64(300*time.Millisecond))
+	var aborted int32
+	apn := newTestApn(t, s, time.Second, WithOnDropped(func(n *Notification, reason error) {
+		if reason == ErrAborted {
+			atomic.AddInt32(&aborted, 1)
+		}
+	}))
+
+	const sends = 20
+	errs := make(chan error, sends)
+	for i := 0; i < sends; i++ {
+		go func(i int) {
+			errs <- apn.Send(testNotification(testToken(byte(i)), "hello"))
+		}(i)
+	}
+	time.Sleep(100 * time.Millisecond)
+	apn.Abort()
+	closed := int32(0)
+	for i := 0; i < sends; i++ {
+		if err := <-errs; err == ErrClosed {
+			closed++
+		} else if err == nil {
+			t.Errorf("sent after Abort")
+		}
+	}
+	if got := atomic.LoadInt32(&aborted); got != closed || got < sends-1 {
+		t.Errorf("got %d dropped, %d closed, expect %d", got, closed, sends)
+	}
+	select {
+	case f := <-s.frames:
+		t.Errorf("got sent %s", f.token)
+	case <-time.After(400 * time.Millisecond):
+	}
+	if err := apn.Send(testNotification(testToken(0x01), "hello")); err != ErrClosed {
+		t.Errorf("got: %v, expect: %s", err, ErrClosed)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	bad := testToken(0xbb)
+	for _, c := range []struct {
+		drain, ctx time.Duration
+		queued     bool
+		token      string
+		expect     error
+		within     time.Duration
+	}{
+		// the earlier of the drain timeout and the context wins
+		{100 * time.Millisecond, 2 * time.Second, true, testToken(0x01), ErrDrainTimeout, 400 * time.Millisecond},
+		{2 * time.Second, 100 * time.Millisecond, true, testToken(0x01), context.DeadlineExceeded, 400 * time.Millisecond},
+		// Apple reported nothing
+		{100 * time.Millisecond, 2 * time.Second, false, testToken(0x01), nil, 400 * time.Millisecond},
+		// Apple closing the connection after an error ends the wait
+		{2 * time.Second, 5 * time.Second, false, bad, nil, time.Second},
+	} {
+		s := newTestServer(t, func(f testFrame) uint8 {
+			if f.token == bad {
+				return statusInvalidToken
+			}
+			return 0
+		})
+		apn := newTestApn(t, s, 10*time.Second, WithDrainTimeout(c.drain))
+		go func() {
+			for range apn.ErrorChan {
+			}
+		}()
+		if err := apn.Send(testNotification(c.token, "hello")); err != nil {
+			t.Fatalf("send error: %s", err)
+		}
+		if c.queued {
+			// reconnecting takes long enough for a send to wait its turn
+			atomic.StoreInt64(&s.handshakeDelay, int64(time.Second))
+			go apn.Reconnect()
+			time.Sleep(50 * time.Millisecond)
+			go apn.Send(testNotification(testToken(0x02), "hello"))
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), c.ctx)
+		start := time.Now()
+		if got := apn.Shutdown(ctx); got != c.expect {
+			t.Errorf("drain %s, ctx %s: got: %v, expect: %v", c.drain, c.ctx, got, c.expect)
+		}
+		if took := time.Since(start); took > c.within {
+			t.Errorf("drain %s, ctx %s: took %s", c.drain, c.ctx, took)
+		}
+		cancel()
+		if err := apn.Send(testNotification(testToken(0x01), "hello")); err != ErrClosed {
+			t.Errorf("got: %v, expect: %s", err, ErrClosed)
+		}
+		s.Close()
+	}
+}
+
+func TestWithTruncateBody(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	apn := newTestApn(t, s, time.Second, WithTruncateBody())
+	defer apn.Close()
+
+	long := strings.Repeat("x", 300)
+	n := testNotification(testToken(0x01), long)
+	if err := apn.Send(n); err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+	f := <-s.frames
+	if len(f.payload) > maxPayloadBytes || !strings.Contains(f.payload, ellipsis) {
+		t.Errorf("got %d bytes: %s", len(f.payload), f.payload)
+	}
+	if n.Payload.Aps.AlertString != long {
+		t.Errorf("the notification's payload was changed")
+	}
+
+	// too large without the body too
+	n = testNotification(testToken(0x01), "hello")
+	n.Payload.SetCustom("data", long)
+	var tooLarge *PayloadTooLargeError
+	if err := apn.Send(n); !errors.As(err, &tooLarge) {
+		t.Errorf("got: %v, expect a PayloadTooLargeError", err)
+	}
+}
+
+type testStructuredLogger struct {
+	events chan map[string]interface{}
+}
+
+func (l testStructuredLogger) Log(level string, fields map[string]interface{}) {
+	fields["level"] = level
+	l.events <- fields
+}
+
+func TestStructuredLogger(t *testing.T) {
+	bad := testToken(0xbb)
+	s := newTestServer(t, func(f testFrame) uint8 {
+		if f.token == bad {
+			return statusInvalidToken
+		}
+		return 0
+	})
+	defer s.Close()
+	logger := testStructuredLogger{make(chan map[string]interface{}, 10)}
+	apn := newTestApn(t, s, time.Second, WithStructuredLogger(logger), WithTokenRedaction(4))
+	defer apn.Close()
+	go func() {
+		for range apn.ErrorChan {
+		}
+	}()
+	expect := func(fields map[string]interface{}) {
+		t.Helper()
+		select {
+		case got := <-logger.events:
+			for k, v := range fields {
+				if got[k] != v {
+					t.Errorf("%s: got: %v, expect: %v in %v", k, got[k], v, got)
+				}
+			}
+			if _, ok := got["latency_ms"].(float64); !ok && got["level"] != "error" && got["level"] != "warn" {
+				t.Errorf("no latency in %v", got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no %s event", fields["event"])
+		}
+	}
+
+	if err := apn.Send(testNotification(bad, "hello")); err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+	redacted := "..." + bad[len(bad)-4:]
+	expect(map[string]interface{}{"event": "connect", "level": "info", "server": s.listener.Addr().String()})
+	expect(map[string]interface{}{"event": "send", "level": "debug", "token": redacted, "identifier": uint32(0)})
+	expect(map[string]interface{}{"event": "error", "level": "error", "token": redacted, "identifier": uint32(0), "status": uint8(statusInvalidToken)})
+	expect(map[string]interface{}{"event": "drop", "level": "warn", "token": redacted})
+
+	// Apple closed the connection after the error
+	if err := apn.Send(testNotification(testToken(0x01), "hello")); err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+	expect(map[string]interface{}{"event": "reconnect", "level": "info"})
+	expect(map[string]interface{}{"event": "send", "level": "debug", "identifier": uint32(1)})
+}
+
+func TestPayloadWarnThreshold(t *testing.T) {
+	logger := testLogger{make(chan string, 10)}
+	apn := &Apn{maxPayloadBytes: 32, payloadWarnAt: 28, logger: logger, dryRun: true}
+
+	// {"aps":{"alert":""}} is 20 bytes
+	for _, c := range []struct {
+		body string
+		warn bool
+	}{
+		{"01234567", false},
+		{"012345678", true},
+	} {
+		if _, err := apn.send(testNotification(testToken(0x01), c.body)); err != nil {
+			t.Fatalf("send error: %s", err)
+		}
+		select {
+		case line := <-logger.lines:
+			if !c.warn {
+				t.Errorf("%d byte payload got warning: %s", 20+len(c.body), line)
+			}
+		default:
+			if c.warn {
+				t.Errorf("%d byte payload got no warning", 20+len(c.body))
+			}
+		}
+	}
+}
+
+func TestMaxSendsPerConnection(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	apn := newTestApn(t, s, time.Second, WithMaxSendsPerConnection(2))
+	defer apn.Close()
+
+	for i := 0; i < 5; i++ {
+		if err := apn.Send(testNotification(testToken(0x01), "hello")); err != nil {
+			t.Fatalf("send error: %s", err)
+		}
+		<-s.frames
+		// give readError time to see each closed connection
+		time.Sleep(50 * time.Millisecond)
+	}
+	// closing a connection after its sends isn't an error
+	select {
+	case err := <-apn.ErrorChan:
+		t.Errorf("got error: %s", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := apn.LastError(); err != nil {
+		t.Errorf("got last error: %s", err)
+	}
+	if got := atomic.LoadInt32(&s.accepted); got != 3 {
+		t.Errorf("got %d connections, expect 3", got)
+	}
+	if got := apn.ConnectionSends(); got != 1 {
+		t.Errorf("got %d sends on the connection, expect 1", got)
+	}
+}
+
+func TestRawPayload(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	apn := newTestApn(t, s, time.Second, WithMaxPayloadBytes(32))
+	defer apn.Close()
+
+	{
+		raw := []byte(`{ "aps" : {"alert":"hi"} }`)
+		n := &Notification{DeviceToken: testToken(0x01), Payload: &Payload{}, RawPayload: raw}
+		if err := apn.Send(n); err != nil {
+			t.Fatalf("send error: %s", err)
+		}
+		if got, expect := (<-s.frames).payload, string(raw); got != expect {
+			t.Errorf("got: %s, expect: %s", got, expect)
+		}
+	}
+
+	for _, raw := range []string{`{"aps":`, `["aps"]`, ` "aps"`} {
+		n := &Notification{DeviceToken: testToken(0x01), RawPayload: []byte(raw)}
+		if got, expect := apn.Send(n), ErrInvalidRawPayload; got != expect {
+			t.Errorf("%s: got: %v, expect: %s", raw, got, expect)
+		}
+	}
+
+	{
+		raw := []byte(`{"aps":{"alert":"hi"},"debug":"0123456789abcdef"}`)
+		n := &Notification{DeviceToken: testToken(0x01), RawPayload: raw}
+		var e *PayloadTooLargeError
+		if err := apn.Send(n); !errors.As(err, &e) {
+			t.Errorf("got: %v, expect a PayloadTooLargeError", err)
+		} else if e.ApsBytes != len(`{"alert":"hi"}`) {
+			t.Errorf("got aps: %d bytes of %s", e.ApsBytes, e.Payload)
+		}
+	}
+}
+
+func TestStrictCustomKeys(t *testing.T) {
+	apn := &Apn{maxPayloadBytes: maxPayloadBytes, dryRun: true}
+	WithStrictCustomKeys()(apn)
+	n := testNotification(testToken(0x01), "hello")
+	if _, err := apn.send(n); err != nil {
+		t.Errorf("got: %s, expect no error", err)
+	}
+	n.Payload.SetCustom("aps", 1)
+	var e *ReservedKeyError
+	if _, err := apn.send(n); !errors.As(err, &e) {
+		t.Errorf("got: %v, expect a ReservedKeyError", err)
+	}
+}
+
+func TestStrictRawPayload(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	apn := newTestApn(t, s, time.Second, WithStrictRawPayload())
+	defer apn.Close()
+
+	raw := `{"aps":{"alert":"hi"},"id":1}`
+	if err := apn.Send(&Notification{DeviceToken: testToken(0x01), RawPayload: []byte(raw)}); err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+	if got := (<-s.frames).payload; got != raw {
+		t.Errorf("got: %s, expect: %s", got, raw)
+	}
+	n := &Notification{DeviceToken: testToken(0x01), RawPayload: []byte(`{"mdm":"magic"}`)}
+	if got, expect := apn.Send(n), ErrMissingAps; got != expect {
+		t.Errorf("got: %v, expect: %s", got, expect)
+	}
+}
+
+func BenchmarkRawPayload(b *testing.B) {
+	payload := &Payload{}
+	payload.Aps.AlertString = "hello world!"
+	payload.Aps.Badge = 1
+	payload.SetCustom("thread", "t-1234")
+	raw, err := payload.MarshalJSON()
+	if err != nil {
+		b.Fatal(err)
+	}
+	token := testToken(0x01)
+
+	for _, c := range []struct {
+		name string
+		raw  []byte
+	}{
+		{"payload", nil},
+		{"raw", raw},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				n := &Notification{DeviceToken: token, Payload: payload, RawPayload: c.raw}
+				if _, _, err := n.validate(maxPayloadBytes); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// Writes at most max bytes at a time, without an error.
+type shortWriter struct {
+	bytes.Buffer
+	max int
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > w.max {
+		p = p[:w.max]
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestWriteFullShortWrites(t *testing.T) {
+	token, _ := DecodeToken(testToken(0x01))
+	frame := encodeEnhanced(7, 0, token, []byte(`{"aps":{"alert":"hello"}}`))
+
+	{
+		w := &shortWriter{max: 10}
+		if n, err := writeFull(w, frame); err != nil || n != len(frame) {
+			t.Fatalf("got: %d, %v, expect: %d, nil", n, err, len(frame))
+		}
+		f, err := readTestFrame(&w.Buffer)
+		if err != nil {
+			t.Fatalf("read error: %s", err)
+		}
+		if f.identifier != 7 || f.token != testToken(0x01) || f.payload != `{"aps":{"alert":"hello"}}` {
+			t.Errorf("got frame: %+v", f)
+		}
+	}
+
+	{
+		w := &shortWriter{max: 0}
+		if _, err := writeFull(w, frame); err != io.ErrShortWrite {
+			t.Errorf("got: %v, expect: %s", err, io.ErrShortWrite)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package apns
+
+import (
+	"errors"
+	"hash/fnv"
+	"sync"
+)
+
+// How Broadcast sends.
+type BroadcastOptions struct {
+	// Number of connections to send over, the Apn's own included. 0 or 1
+	// sends over the Apn only.
+	Concurrency int
+	// Shard tokens by their hash instead of round robin, so every occurrence
+	// of a token goes over the same connection, in the order of tokens.
+	// Shards may then get uneven, and ones without tokens don't connect.
+	SerializePerToken bool
+}
+
+// Send payload to every token, marshaled once, sharding the tokens across
+// opts.Concurrency connections, and stream the result for each token back.
+// The payload is checked and truncated like Send does it.
+// The channel is closed after the last result. The extra connections are
+// Apns configured like a, their errors go to a's ErrorChan while they're
+// open; they're closed once their shard is sent, dropping errors Apple
+// reports after that. An Apn made by NewWithConn has only its one connection,
+// so it sends everything over it.
+func (a *Apn) Broadcast(tokens []string, payload *Payload, opts BroadcastOptions) <-chan SendResult {
+	concurrency := opts.Concurrency
+	if concurrency < 1 || a.newLike == nil {
+		concurrency = 1
+	}
+	if concurrency > len(tokens) && len(tokens) > 0 {
+		concurrency = len(tokens)
+	}
+	results := make(chan SendResult, concurrency)
+	// marshal once for all tokens; if it fails, every send reports why
+	var sent []byte
+	if payload != nil {
+		sent = a.marshalOnce(payload)
+	}
+
+	shards := make([][]string, concurrency)
+	for i, token := range tokens {
+		shard := i % concurrency
+		if opts.SerializePerToken {
+			h := fnv.New32a()
+			h.Write([]byte(token))
+			shard = int(h.Sum32() % uint32(concurrency))
+		}
+		shards[shard] = append(shards[shard], token)
+	}
+
+	var wg sync.WaitGroup
+	for shard, shardTokens := range shards {
+		if len(shardTokens) == 0 {
+			continue
+		}
+		wg.Add(1)
+		shard, tokens := shard, shardTokens
+		a.spawn(func() {
+			defer wg.Done()
+			apn := a
+			if shard > 0 {
+				sibling, err := a.sibling()
+				if err != nil {
+					for _, token := range tokens {
+						results <- SendResult{Token: token, Err: err}
+					}
+					return
+				}
+				defer sibling.Close()
+				apn = sibling
+			}
+			for _, token := range tokens {
+				results <- apn.SendWithResult(&Notification{DeviceToken: token, Payload: payload, sent: sent})
+			}
+		})
+	}
+	a.spawn(func() {
+		wg.Wait()
+		close(results)
+	})
+	return results
+}
+
+// Marshal payload the way send does, checked and truncated to fit like a
+// notification with it would be, or return nil if sending it fails.
+func (a *Apn) marshalOnce(payload *Payload) []byte {
+	n := &Notification{DeviceToken: selfTestToken, Payload: payload}
+	_, sent, err := n.validate(a.maxPayloadBytes)
+	var tooLarge *PayloadTooLargeError
+	if a.truncateBody && errors.As(err, &tooLarge) {
+		_, sent, err = n.truncated(a.maxPayloadBytes, err)
+	}
+	if err == nil && a.strictKeys {
+		err = payload.CheckCustomKeys()
+	}
+	if err != nil {
+		return nil
+	}
+	return sent
+}
+
+// Make another Apn configured like a, with a's current TLS config and
+// server, passing its errors on to a's ErrorChan until it's closed. It
+// shares a's stats, token rate limit and DeadLetterChan.
+func (a *Apn) sibling() (*Apn, error) {
+	a.confLock.Lock()
+	conf := a.conf.Clone()
+	server := a.server
+	a.confLock.Unlock()
+	sibling, err := a.newLike(conf.Certificates[0])
+	if err != nil {
+		return nil, err
+	}
+	sibling.confLock.Lock()
+	sibling.conf = conf
+	sibling.server = server
+	sibling.confLock.Unlock()
+	sibling.validators = a.currentValidators()
+
+	a.spawn(func() {
+		for {
+			select {
+			case err := <-sibling.ErrorChan:
+				a.reportError(err)
+			case <-sibling.done:
+				return
+			}
+		}
+	})
+	return sibling, nil
+}
@@ -0,0 +1,294 @@
+package apns
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBroadcast(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	apn := newTestApn(t, s, time.Second)
+	defer apn.Close()
+
+	var tokens []string
+	for i := 0; i < 50; i++ {
+		tokens = append(tokens, testToken(byte(i)))
+	}
+	payload := &Payload{}
+	payload.Aps.AlertString = "hello"
+
+	sent := make(map[string]bool)
+	for r := range apn.Broadcast(tokens, payload, BroadcastOptions{Concurrency: 4}) {
+		if r.Err != nil {
+			t.Errorf("%s send error: %s", r.Token, r.Err)
+		}
+		sent[r.Token] = true
+	}
+	if len(sent) != len(tokens) {
+		t.Errorf("got %d results, expect %d", len(sent), len(tokens))
+	}
+	for range tokens {
+		<-s.frames
+	}
+	if got := atomic.LoadInt32(&s.accepted); got != 4 {
+		t.Errorf("got %d connections, expect 4", got)
+	}
+	if got := apn.Stats().Sent; got != uint64(len(tokens)) {
+		t.Errorf("got %d sent, expect %d", got, len(tokens))
+	}
+}
+
+func TestBroadcastSharesWithSiblings(t *testing.T) {
+	bad := testToken(0xbb)
+	s := newTestServer(t, func(f testFrame) uint8 {
+		if f.token == bad {
+			return statusInvalidToken
+		}
+		return 0
+	})
+	defer s.Close()
+	notAfter := time.Now().Add(1500 * time.Millisecond)
+	certPEM, keyPEM := testCertificateExpiring(t, "127.0.0.1", notAfter)
+	apn, err := NewWithOptions(certPEM, keyPEM, s.listener.Addr().String(), WithTimeout(time.Second), WithDeadLetterChan(1))
+	if err != nil {
+		t.Fatalf("can't create apn: %s", err)
+	}
+	defer apn.Close()
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(s.certPEM)
+	apn.conf.RootCAs = pool
+	apn.conf.ServerName = "127.0.0.1"
+	go func() {
+		for range apn.ErrorChan {
+		}
+	}()
+
+	// the siblings use the current certificate, not the expired first one
+	if err := apn.UpdateCertificate(testCertificate(t)); err != nil {
+		t.Fatalf("can't update certificate: %s", err)
+	}
+	time.Sleep(time.Until(notAfter))
+
+	tokens := []string{testToken(1), testToken(2), bad, testToken(3)}
+	payload := &Payload{}
+	payload.Aps.AlertString = "hello"
+	for r := range apn.Broadcast(tokens, payload, BroadcastOptions{Concurrency: 2}) {
+		if r.Err != nil {
+			t.Errorf("%s send error: %s", r.Token, r.Err)
+		}
+	}
+	select {
+	case d := <-apn.DeadLetterChan:
+		if d.Notification.DeviceToken != bad {
+			t.Errorf("got dead letter %s", d.Notification.DeviceToken)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no dead letter")
+	}
+	if got := apn.Stats().Sent; got != uint64(len(tokens)) {
+		t.Errorf("got %d sent, expect %d", got, len(tokens))
+	}
+}
+
+func TestBroadcastSerializePerToken(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	apn := newTestApn(t, s, time.Second)
+	defer apn.Close()
+
+	var tokens []string
+	for i := 0; i < 40; i++ {
+		tokens = append(tokens, testToken(byte(i%3)))
+	}
+	payload := &Payload{}
+	payload.Aps.AlertString = "hello"
+
+	// every connection numbers its notifications from 0, so the identifiers
+	// for a token only keep growing if they all went over one connection
+	last := make(map[string]uint32)
+	for r := range apn.Broadcast(tokens, payload, BroadcastOptions{Concurrency: 4, SerializePerToken: true}) {
+		if r.Err != nil {
+			t.Fatalf("%s send error: %s", r.Token, r.Err)
+		}
+		if prev, ok := last[r.Token]; ok && r.Identifier <= prev {
+			t.Errorf("%s got identifier %d after %d", r.Token, r.Identifier, prev)
+		}
+		last[r.Token] = r.Identifier
+	}
+	for range tokens {
+		<-s.frames
+	}
+}
+
+func TestBroadcastMissingPayload(t *testing.T) {
+	certPEM, keyPEM := testCertificate(t)
+	apn, err := NewWithOptions(certPEM, keyPEM, "127.0.0.1:1", WithDryRun())
+	if err != nil {
+		t.Fatalf("can't create apn: %s", err)
+	}
+	defer apn.Close()
+
+	for r := range apn.Broadcast([]string{testToken(0x01)}, nil, BroadcastOptions{}) {
+		if got, expect := r.Err, ErrMissingPayload; got != expect {
+			t.Errorf("got: %v, expect: %s", got, expect)
+		}
+	}
+}
+
+func TestBroadcastChecksPayload(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	apn := newTestApn(t, s, time.Second, WithTruncateBody())
+	defer apn.Close()
+	tokens := []string{testToken(0x01), testToken(0x02)}
+
+	// rejected like Send rejects it
+	for r := range apn.Broadcast(tokens, &Payload{}, BroadcastOptions{Concurrency: 2}) {
+		if got, expect := r.Err, ErrEmptyAlertPayload; got != expect {
+			t.Errorf("got: %v, expect: %s", got, expect)
+		}
+	}
+
+	// truncated like Send truncates it
+	long := &Payload{}
+	long.Aps.AlertString = strings.Repeat("x", 300)
+	for r := range apn.Broadcast(tokens, long, BroadcastOptions{Concurrency: 2}) {
+		if r.Err != nil {
+			t.Errorf("%s send error: %s", r.Token, r.Err)
+		}
+	}
+	for range tokens {
+		if f := <-s.frames; len(f.payload) > maxPayloadBytes || !strings.Contains(f.payload, ellipsis) {
+			t.Errorf("got %d bytes: %s", len(f.payload), f.payload)
+		}
+	}
+}
+
+func TestBroadcastWithConn(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	client, server := net.Pipe()
+	go s.serve(tls.Server(server, s.conf))
+	apn, err := NewWithConn(client, s.certPEM, s.keyPEM, 0, WithServerName("127.0.0.1"))
+	if err != nil {
+		t.Fatalf("can't create apn: %s", err)
+	}
+	defer apn.Close()
+	apn.conf.RootCAs = x509.NewCertPool()
+	apn.conf.RootCAs.AppendCertsFromPEM(s.certPEM)
+
+	var tokens []string
+	for i := 0; i < 10; i++ {
+		tokens = append(tokens, testToken(byte(i)))
+	}
+	payload := &Payload{}
+	payload.Aps.AlertString = "hello"
+	for r := range apn.Broadcast(tokens, payload, BroadcastOptions{Concurrency: 4}) {
+		if r.Err != nil {
+			t.Errorf("%s send error: %s", r.Token, r.Err)
+		}
+	}
+	for range tokens {
+		<-s.frames
+	}
+}
+
+func TestBroadcastEagerConnect(t *testing.T) {
+	s1 := newTestServer(t, nil)
+	defer s1.Close()
+	s2 := newTestServer(t, nil)
+	defer s2.Close()
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(s1.certPEM)
+	pool.AppendCertsFromPEM(s2.certPEM)
+	trust := func(a *Apn) {
+		a.conf.RootCAs = pool
+	}
+	apn, err := NewWithOptions(s1.certPEM, s1.keyPEM, s1.listener.Addr().String(), trust, WithServerName("127.0.0.1"), WithEagerConnect())
+	if err != nil {
+		t.Fatalf("can't create apn: %s", err)
+	}
+	defer apn.Close()
+	if err := apn.SwitchServer(s2.listener.Addr().String()); err != nil {
+		t.Fatalf("switch error: %s", err)
+	}
+
+	tokens := []string{testToken(0x01), testToken(0x02)}
+	payload := &Payload{}
+	payload.Aps.AlertString = "hello"
+	for r := range apn.Broadcast(tokens, payload, BroadcastOptions{Concurrency: 2}) {
+		if r.Err != nil {
+			t.Errorf("%s send error: %s", r.Token, r.Err)
+		}
+	}
+	// the sibling connects to the server switched to, not the original one
+	if got := atomic.LoadInt32(&s1.accepted); got != 1 {
+		t.Errorf("got %d connections to the old server, expect 1", got)
+	}
+	if got := atomic.LoadInt32(&s2.accepted); got != 2 {
+		t.Errorf("got %d connections to the new server, expect 2", got)
+	}
+}
+
+func TestSharedPayload(t *testing.T) {
+	bad := testToken(0xbb)
+	s := newTestServer(t, func(f testFrame) uint8 {
+		if f.token == bad {
+			return 8
+		}
+		return 0
+	})
+	defer s.Close()
+	apn := newTestApn(t, s, time.Second)
+	defer apn.Close()
+	go func() {
+		for range apn.ErrorChan {
+		}
+	}()
+
+	shared := &Payload{}
+	shared.Aps.AlertString = "hello"
+	{
+		tokens := make([]string, 20)
+		for i := range tokens {
+			tokens[i] = testToken(byte(i))
+		}
+		done := make(chan struct{})
+		go func() {
+			for i := 0; i < 10; i++ {
+				apn.Send(&Notification{DeviceToken: testToken(0x40), Payload: shared})
+			}
+			close(done)
+		}()
+		for r := range apn.Broadcast(tokens, shared, BroadcastOptions{Concurrency: 4}) {
+			if r.Err != nil {
+				t.Errorf("%s: send error: %s", r.Token, r.Err)
+			}
+		}
+		<-done
+		for i := 0; i < 30; i++ {
+			<-s.frames
+		}
+	}
+
+	// the one sent after the rejected one is resent as it was first sent
+	apn.Send(&Notification{DeviceToken: bad, Payload: shared})
+	if err := apn.Send(&Notification{DeviceToken: testToken(0x01), Payload: shared}); err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+	shared.Aps.AlertString = "changed"
+	select {
+	case f := <-s.frames:
+		if got, expect := f.payload, `{"aps":{"alert":"hello"}}`; got != expect {
+			t.Errorf("got: %s, expect: %s", got, expect)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("not resent")
+	}
+}
@@ -0,0 +1,52 @@
+package apns
+
+import (
+	"errors"
+)
+
+// What to do with a notification Apple reported an error for.
+type Disposition int
+
+const (
+	// Give up on the notification.
+	Drop Disposition = iota
+	// Resend the notification once, with the ones Apple dropped after it.
+	Retry
+	// Give up on the notification and stop sending to its device token: a
+	// Service passes the token to onInvalidToken.
+	RemoveToken
+)
+
+// Status Apple replies with when it failed to process a notification.
+const statusProcessing = 1
+
+// Status Apple replies with when it closes the connection, e.g. for
+// maintenance. Its identifier is the last notification Apple did deliver.
+const statusShutdown = 10
+
+// The default classifier, see WithClassifier. Invalid tokens are
+// RemoveToken, processing errors and shutdowns are Retry, everything else,
+// like invalid payload sizes, is Drop. Apple delivered the notification a
+// shutdown names, so Retry there only resends the ones after it, which
+// happens after every error anyway.
+func DefaultClassify(err error) Disposition {
+	var e NotificationError
+	if !errors.As(err, &e) || e.OtherError != nil || e.Command != 8 {
+		return Drop
+	}
+	switch e.Status {
+	case statusInvalidToken:
+		return RemoveToken
+	case statusProcessing, statusShutdown:
+		return Retry
+	}
+	return Drop
+}
+
+// Classify err with the WithClassifier classifier.
+func (a *Apn) classify(err error) Disposition {
+	if a.classifier == nil {
+		return DefaultClassify(err)
+	}
+	return a.classifier(err)
+}
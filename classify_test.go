@@ -0,0 +1,169 @@
+package apns
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDefaultClassify(t *testing.T) {
+	for _, c := range []struct {
+		err    error
+		expect Disposition
+	}{
+		{NotificationError{Command: 8, Status: 8}, RemoveToken},
+		{NotificationError{Command: 8, Status: 1}, Retry},
+		{NotificationError{Command: 8, Status: 10}, Retry},
+		{NotificationError{Command: 8, Status: 7}, Drop},
+		{NotificationError{Command: 9, Status: 8}, Drop},
+		{NotificationError{OtherError: errors.New("read error")}, Drop},
+		{ErrClosed, Drop},
+	} {
+		if got := DefaultClassify(c.err); got != c.expect {
+			t.Errorf("%v: got: %d, expect: %d", c.err, got, c.expect)
+		}
+	}
+}
+
+func TestRequeueRetry(t *testing.T) {
+	bad := testNotification(testToken(0xbb), "bad")
+	n := testNotification(testToken(0x01), "first")
+	apn := &Apn{
+		inflight: []inFlight{{identifier: 1, notification: bad, expiry: 1000}, {identifier: 2, notification: n, expiry: 1060}},
+		classifier: func(err error) Disposition {
+			return Retry
+		},
+	}
+
+	// the failed notification goes first, before the ones dropped after it
+	apn.requeue(&NotificationError{Command: 8, Status: 8, Identifier: 1})
+	if len(apn.resend) != 2 {
+		t.Fatalf("got %d to resend, expect 2", len(apn.resend))
+	}
+	retried := apn.resend[0]
+	if got, expect := retried.DeviceToken, bad.DeviceToken; got != expect {
+		t.Errorf("got: %s, expect: %s", got, expect)
+	}
+	if got, expect := apn.resend[1].DeviceToken, n.DeviceToken; got != expect {
+		t.Errorf("got: %s, expect: %s", got, expect)
+	}
+
+	// and is only retried once
+	apn.resend = nil
+	apn.inflight = []inFlight{{identifier: 3, notification: retried, expiry: 1000}}
+	apn.requeue(&NotificationError{Command: 8, Status: 8, Identifier: 3})
+	if len(apn.resend) != 0 {
+		t.Errorf("got %d to resend, expect 0", len(apn.resend))
+	}
+
+	// Apple delivered the notification a shutdown names
+	apn.inflight = []inFlight{{identifier: 4, notification: bad, expiry: 1000}}
+	apn.requeue(&NotificationError{Command: 8, Status: 10, Identifier: 4})
+	if len(apn.resend) != 0 {
+		t.Errorf("got %d to resend, expect 0", len(apn.resend))
+	}
+}
+
+func TestRetryReconnects(t *testing.T) {
+	for _, c := range []struct {
+		status uint8
+		resend bool
+	}{
+		{statusProcessing, true},
+		{statusInvalidToken, false},
+	} {
+		bad := testToken(0xbb)
+		rejected := int32(0)
+		s := newTestServer(t, func(f testFrame) uint8 {
+			if f.token == bad && atomic.AddInt32(&rejected, 1) == 1 {
+				return c.status
+			}
+			return 0
+		})
+		apn := newTestApn(t, s, time.Second)
+		go func() {
+			for range apn.ErrorChan {
+			}
+		}()
+		if err := apn.Send(testNotification(bad, "hello")); err != nil {
+			t.Fatalf("send error: %s", err)
+		}
+		select {
+		case f := <-s.frames:
+			if !c.resend || f.token != bad {
+				t.Errorf("status %d: got resent %s", c.status, f.token)
+			}
+			if got := atomic.LoadInt32(&s.accepted); got != 2 {
+				t.Errorf("status %d: got %d connections, expect 2", c.status, got)
+			}
+		case <-time.After(500 * time.Millisecond):
+			if c.resend {
+				t.Errorf("status %d: not resent", c.status)
+			}
+		}
+		apn.Close()
+		s.Close()
+	}
+}
+
+func TestServiceClassifier(t *testing.T) {
+	big := testToken(0xbb)
+	s := newTestServer(t, func(f testFrame) uint8 {
+		if f.token == big {
+			return 7
+		}
+		return 0
+	})
+	defer s.Close()
+
+	apn := newTestApn(t, s, time.Second, WithClassifier(func(err error) Disposition {
+		if e, ok := err.(NotificationError); ok && e.Status == 7 {
+			return RemoveToken
+		}
+		return DefaultClassify(err)
+	}))
+	invalid := make(chan string, 1)
+	service := NewService(apn, func(token string) {
+		invalid <- token
+	}, nil)
+
+	if err := service.Send(testNotification(big, "hello")); err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+	select {
+	case got := <-invalid:
+		if got != big {
+			t.Errorf("got: %s, expect: %s", got, big)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("token not removed")
+	}
+}
+
+func TestServiceClassifiesAppleErrorsOnly(t *testing.T) {
+	echan := make(chan error, 1)
+	apn := &Apn{
+		ErrorChan: echan,
+		done:      make(chan struct{}),
+		classifier: func(err error) Disposition {
+			return RemoveToken
+		},
+	}
+	errs := make(chan error, 1)
+	service := NewService(apn, func(token string) {
+		t.Errorf("removed token %s after a local error", token)
+	}, func(err error) {
+		errs <- err
+	})
+	defer service.Close()
+
+	e := NewNotificationError(nil, errors.New("write socket error"))
+	e.notification = testNotification(testToken(0x01), "hello")
+	echan <- e
+	select {
+	case <-errs:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("local error not passed to onError")
+	}
+}
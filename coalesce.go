@@ -0,0 +1,80 @@
+package apns
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Report whether n only updates the badge.
+func isBadgeOnly(n *Notification) bool {
+	p := n.Payload
+	if p == nil || n.RawPayload != nil || p.Aps.Badge == 0 {
+		return false
+	}
+	return p.Aps.AlertString == "" && p.Aps.AlertDictionary == nil && !p.Aps.ForceAlertDict &&
+		p.Aps.Sound == "" && !p.Aps.Silent && !p.Aps.ContentAvailable &&
+		len(p.customProperty) == 0 && p.customData == nil
+}
+
+// Hold n back for the coalescing window, replacing any badge update to the
+// same token still waiting. Only the latest one is sent when the window ends.
+func (a *Apn) coalesceBadge(n *Notification) {
+	a.coalesceLock.Lock()
+	defer a.coalesceLock.Unlock()
+	if a.coalesced == nil {
+		a.coalesced = make(map[string]*Notification)
+	}
+	_, waiting := a.coalesced[n.DeviceToken]
+	// Send has returned by the time it's sent, the caller may change n
+	a.coalesced[n.DeviceToken] = n.Clone()
+	if !waiting {
+		time.AfterFunc(a.coalesceWindow, func() {
+			a.addWorkers(1)
+			defer a.addWorkers(-1)
+			a.flushBadge(n.DeviceToken)
+		})
+	}
+}
+
+// Send the badge update waiting for token, if any.
+func (a *Apn) flushBadge(token string) {
+	a.coalesceLock.Lock()
+	n := a.coalesced[token]
+	delete(a.coalesced, token)
+	a.coalesceLock.Unlock()
+	if n == nil {
+		return
+	}
+	r := a.submit(context.Background(), n)
+	if r.Err != nil && r.Err != ErrClosed {
+		e := NewNotificationError(nil, r.Err)
+		e.Identifier = r.Identifier
+		e.generation = atomic.LoadUint32(&a.generation)
+		e.notification = n
+		e.tokenShown = a.tokenShown
+		a.reportError(e)
+	}
+}
+
+// Send every badge update waiting for its coalescing window to end, and
+// write out what the write buffer holds, e.g. at the end of a batch. ctx
+// bounds handing the badge updates to the connection; writing is bounded by
+// WithWriteTimeout. The first error is returned, after trying everything.
+func (a *Apn) Flush(ctx context.Context) error {
+	a.coalesceLock.Lock()
+	waiting := a.coalesced
+	a.coalesced = nil
+	a.coalesceLock.Unlock()
+	var first error
+	for _, n := range waiting {
+		if err := a.submit(ctx, n).Err; err != nil && first == nil {
+			first = err
+		}
+	}
+	if err := a.flush(); err != nil && first == nil {
+		first = fmt.Errorf("flush socket error: %s", err)
+	}
+	return first
+}
@@ -0,0 +1,127 @@
+package apns
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCoalesceBadgeUpdates(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	apn := newTestApn(t, s, time.Second, WithCoalesceBadgeUpdates(100*time.Millisecond))
+	defer apn.Close()
+
+	for badge := 1; badge <= 3; badge++ {
+		payload := &Payload{}
+		payload.Aps.Badge = badge
+		if err := apn.Send(&Notification{DeviceToken: testToken(0x01), Payload: payload}); err != nil {
+			t.Fatalf("send error: %s", err)
+		}
+	}
+
+	select {
+	case f := <-s.frames:
+		if got, expect := f.payload, `{"aps":{"badge":3}}`; got != expect {
+			t.Errorf("got: %s, expect: %s", got, expect)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("badge update not sent")
+	}
+	select {
+	case f := <-s.frames:
+		t.Errorf("got another frame: %s", f.payload)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	{
+		payload := &Payload{}
+		payload.Aps.Badge = 4
+		apn.Send(&Notification{DeviceToken: testToken(0x01), Payload: payload})
+		if err := apn.Send(testNotification(testToken(0x01), "hello")); err != nil {
+			t.Fatalf("send error: %s", err)
+		}
+		// the waiting badge update goes out first
+		if got, expect := (<-s.frames).payload, `{"aps":{"badge":4}}`; got != expect {
+			t.Errorf("got: %s, expect: %s", got, expect)
+		}
+		if got, expect := (<-s.frames).payload, `{"aps":{"alert":"hello"}}`; got != expect {
+			t.Errorf("got: %s, expect: %s", got, expect)
+		}
+	}
+}
+
+func TestCoalescedBadgeError(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	apn := newTestApn(t, s, time.Second, WithCoalesceBadgeUpdates(50*time.Millisecond),
+		WithTokenRateLimit(1, time.Hour, false))
+	defer apn.Close()
+
+	if err := apn.Send(testNotification(testToken(0x01), "hello")); err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+	<-s.frames
+	payload := &Payload{}
+	payload.Aps.Badge = 1
+	if err := apn.Send(&Notification{DeviceToken: testToken(0x01), Payload: payload}); err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+
+	// the held back update failing is the notification's error, not the
+	// connection's
+	select {
+	case err := <-apn.ErrorChan:
+		e, ok := err.(NotificationError)
+		if !ok || !errors.Is(err, ErrTokenRateLimited) {
+			t.Fatalf("got: %v, expect: %s", err, ErrTokenRateLimited)
+		}
+		if e.IsConnectionError() {
+			t.Errorf("got a connection error")
+		}
+		if n := e.Notification(); n == nil || n.DeviceToken != testToken(0x01) || n.Payload.Aps.Badge != 1 {
+			t.Errorf("got notification %v", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no error")
+	}
+}
+
+func TestFlush(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	apn := newTestApn(t, s, time.Minute, WithCoalesceBadgeUpdates(time.Hour),
+		WithWriteBufferSize(4096), WithFlushInterval(time.Hour))
+	defer apn.Close()
+
+	payload := &Payload{}
+	payload.Aps.Badge = 1
+	if err := apn.Send(&Notification{DeviceToken: testToken(0x01), Payload: payload}); err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+	if err := apn.Send(testNotification(testToken(0x02), "hello")); err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+	select {
+	case f := <-s.frames:
+		t.Fatalf("got a frame before flushing: %s", f.payload)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := apn.Flush(context.Background()); err != nil {
+		t.Fatalf("flush error: %s", err)
+	}
+	got := map[string]string{}
+	for i := 0; i < 2; i++ {
+		select {
+		case f := <-s.frames:
+			got[f.token] = f.payload
+		case <-time.After(time.Second):
+			t.Fatalf("got %d frames, expect 2", i)
+		}
+	}
+	if got[testToken(0x01)] != `{"aps":{"badge":1}}` || got[testToken(0x02)] != `{"aps":{"alert":"hello"}}` {
+		t.Errorf("got: %v", got)
+	}
+}
@@ -0,0 +1,121 @@
+package apns
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Most device tokens a DualEnvironmentSender remembers the environment of;
+// the least recently sent to is forgotten beyond that.
+const maxKnownTokens = 10000
+
+// A DualEnvironmentSender sends over two Apns, one per environment, e.g.
+// production and the sandbox, for device tokens whose environment isn't
+// known, like during a TestFlight to App Store transition. A notification
+// Apple rejects as an invalid token in one environment is sent in the other,
+// and the environment that took it is remembered for the token. The
+// rejections still go to the Apns' ErrorChans, which need reading as usual.
+type DualEnvironmentSender struct {
+	first  *Apn
+	second *Apn
+	wait   time.Duration
+
+	lock   sync.Mutex
+	recent *list.List // of *knownToken, most recently sent to first
+	known  map[string]*list.Element
+}
+
+type knownToken struct {
+	token  string
+	second bool
+}
+
+// New DualEnvironmentSender trying first, then second. Apple only answers
+// failures, so each attempt waits up to wait for a rejection before counting
+// as sent.
+func NewDualEnvironmentSender(first, second *Apn, wait time.Duration) *DualEnvironmentSender {
+	return &DualEnvironmentSender{
+		first:  first,
+		second: second,
+		wait:   wait,
+		recent: list.New(),
+		known:  make(map[string]*list.Element),
+	}
+}
+
+// Send notification in the environment remembered for its token, or else in
+// the first then the second, like SendAndWait. ctx bounds the whole send.
+// Returns the last environment's rejection if both reject the token as
+// invalid, and forgets the token's environment then.
+func (d *DualEnvironmentSender) Send(ctx context.Context, notification *Notification) error {
+	if notification == nil {
+		return ErrNilNotification
+	}
+	order := []bool{false, true}
+	if second, ok := d.lookup(notification.DeviceToken); ok && second {
+		order = []bool{true, false}
+	}
+	var err error
+	for _, second := range order {
+		apn := d.first
+		if second {
+			apn = d.second
+		}
+		attempt, cancel := context.WithTimeout(ctx, d.wait)
+		_, err = apn.SendAndWait(attempt, notification)
+		cancel()
+		if !isInvalidToken(err) {
+			if err == nil {
+				d.remember(notification.DeviceToken, second)
+			}
+			return err
+		}
+	}
+	d.forget(notification.DeviceToken)
+	return err
+}
+
+// Report whether err is Apple rejecting a device token as invalid.
+func isInvalidToken(err error) bool {
+	var e NotificationError
+	return errors.As(err, &e) && e.OtherError == nil && e.Command == 8 && e.Status == statusInvalidToken
+}
+
+// The environment remembered for token, and whether there is one.
+func (d *DualEnvironmentSender) lookup(token string) (second, ok bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	e, ok := d.known[token]
+	if !ok {
+		return false, false
+	}
+	d.recent.MoveToFront(e)
+	return e.Value.(*knownToken).second, true
+}
+
+func (d *DualEnvironmentSender) remember(token string, second bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if e, ok := d.known[token]; ok {
+		e.Value.(*knownToken).second = second
+		d.recent.MoveToFront(e)
+		return
+	}
+	d.known[token] = d.recent.PushFront(&knownToken{token, second})
+	if d.recent.Len() > maxKnownTokens {
+		oldest := d.recent.Remove(d.recent.Back()).(*knownToken)
+		delete(d.known, oldest.token)
+	}
+}
+
+func (d *DualEnvironmentSender) forget(token string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if e, ok := d.known[token]; ok {
+		d.recent.Remove(e)
+		delete(d.known, token)
+	}
+}
@@ -0,0 +1,55 @@
+package apns
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDualEnvironmentSender(t *testing.T) {
+	sandboxOnly := testToken(0xbb)
+	rejected := int32(0)
+	production := newTestServer(t, func(f testFrame) uint8 {
+		if f.token == sandboxOnly {
+			atomic.AddInt32(&rejected, 1)
+			return statusInvalidToken
+		}
+		return 0
+	})
+	defer production.Close()
+	sandbox := newTestServer(t, nil)
+	defer sandbox.Close()
+
+	first := newTestApn(t, production, time.Second)
+	defer first.Close()
+	second := newTestApn(t, sandbox, time.Second)
+	defer second.Close()
+	for _, apn := range []*Apn{first, second} {
+		go func(apn *Apn) {
+			for range apn.ErrorChan {
+			}
+		}(apn)
+	}
+	d := NewDualEnvironmentSender(first, second, 200*time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		if err := d.Send(context.Background(), testNotification(sandboxOnly, "hello")); err != nil {
+			t.Fatalf("send error: %s", err)
+		}
+		if got := (<-sandbox.frames).token; got != sandboxOnly {
+			t.Errorf("got: %s, expect: %s", got, sandboxOnly)
+		}
+	}
+	// the second send went to the sandbox right away
+	if got := atomic.LoadInt32(&rejected); got != 1 {
+		t.Errorf("got %d rejections, expect 1", got)
+	}
+
+	if err := d.Send(context.Background(), testNotification(testToken(0x01), "hello")); err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+	if got := (<-production.frames).token; got != testToken(0x01) {
+		t.Errorf("got: %s, expect: %s", got, testToken(0x01))
+	}
+}
@@ -1,15 +1,155 @@
 package apns
 
 import (
+	"errors"
 	"fmt"
 )
 
+var (
+	// A device token isn't 32 bytes long.
+	ErrInvalidTokenSize = errors.New("invalid token size")
+	// A notification's Priority is neither 5 nor 10.
+	ErrInvalidPriority = errors.New("invalid priority, must be 5 or 10")
+	// A notification has no device token.
+	ErrEmptyDeviceToken = errors.New("empty device token")
+	// Apple sent something that isn't an error response (command 8).
+	ErrMalformedResponse = errors.New("malformed response")
+	// Apple closed the connection right after it was made, without saying
+	// why. This usually means the certificate is for the other environment
+	// (sandbox vs production) or was revoked.
+	ErrConnectionRefusedByApple = errors.New("connection refused by apple, check the certificate matches the gateway")
+	// Apn has no connection to Apple right now. Close still returns nil
+	// then.
+	ErrNotConnected = errors.New("not connected")
+	// Apn is closed.
+	ErrClosed = errors.New("apn closed")
+	// Shutdown's queued sends weren't sent within the WithDrainTimeout
+	// timeout.
+	ErrDrainTimeout = errors.New("drain timed out")
+	// Abort dropped the notification before it was sent.
+	ErrAborted = errors.New("apn aborted")
+	// A VoIP topic is used with a certificate that can't send VoIP pushes.
+	ErrNotVoIPCertificate = errors.New("certificate doesn't support VoIP pushes")
+	// The connection has as many notifications in flight as WithMaxInFlight
+	// allows.
+	ErrInFlightFull = errors.New("too many notifications in flight")
+	// SendBatch stopped before the notification, see WithBatchPolicy.
+	ErrNotAttempted = errors.New("not attempted after an earlier notification failed")
+	// The connection given to NewWithConn was already used and closed.
+	ErrConnUsed = errors.New("connection already used")
+	// The push certificate has expired.
+	ErrCertificateExpired = errors.New("certificate expired")
+	// WithProtocolCommand got a command other than CommandEnhanced or
+	// CommandFramed.
+	ErrUnsupportedCommand = errors.New("unsupported protocol command")
+	// A notification waited longer than WithMaxQueueAge allows.
+	ErrStale = errors.New("notification waited too long to be sent")
+	// A nil *Notification was sent.
+	ErrNilNotification = errors.New("nil notification")
+	// A notification has neither a Payload nor a RawPayload.
+	ErrMissingPayload = errors.New("missing payload")
+	// A notification's Payload has no alert, badge or sound and isn't
+	// content-available, so it would show nothing; custom keys alone don't
+	// make up for it.
+	ErrEmptyAlertPayload = errors.New("empty payload")
+	// A notification's RawPayload isn't a valid JSON object.
+	ErrInvalidRawPayload = errors.New("raw payload isn't a valid json object")
+	// A notification's RawPayload has no aps key, see WithStrictRawPayload.
+	ErrMissingAps = errors.New("raw payload has no aps key")
+	// An alert template has a placeholder its vars don't have.
+	ErrMissingTemplateVar = errors.New("missing alert template var")
+	// The WithTokenFilter filter rejected a notification's device token.
+	ErrTokenFiltered = errors.New("device token filtered out")
+	// A notification's device token was sent to more often than
+	// WithTokenRateLimit allows.
+	ErrTokenRateLimited = errors.New("device token sent to too often")
+	// The PEM given for a certificate, or a combined PEM bundle, has no
+	// CERTIFICATE block.
+	ErrNoCertificateInPEM = errors.New("no certificate in pem data")
+	// The PEM given for a private key, or a combined PEM bundle, has no
+	// PRIVATE KEY block.
+	ErrNoPrivateKeyInPEM = errors.New("no private key in pem data")
+	// The private key isn't the one of the certificate.
+	ErrCertKeyMismatch = errors.New("the private key does not match the certificate")
+	// The TLS handshake took longer than WithHandshakeTimeout allows.
+	ErrHandshakeTimeout = errors.New("tls handshake timed out")
+	// Apple didn't reply to SelfTest's notification in time.
+	ErrSelfTestUnconfirmed = errors.New("self test not confirmed by apple")
+)
+
+// An error of the connection itself, see NotificationError.IsConnectionError.
+type connectionError struct {
+	err error
+}
+
+func (e *connectionError) Error() string {
+	return e.err.Error()
+}
+
+func (e *connectionError) Unwrap() error {
+	return e.err
+}
+
+// A custom key collides with one of Apple's, see Payload.CheckCustomKeys.
+type ReservedKeyError struct {
+	Key string
+}
+
+func (e *ReservedKeyError) Error() string {
+	return fmt.Sprintf("custom key %q is reserved", e.Key)
+}
+
+// A payload couldn't be marshaled to JSON.
+type MarshalError struct {
+	Err error
+}
+
+func (e *MarshalError) Error() string {
+	return fmt.Sprintf("convert payload to json: %s", e.Err)
+}
+
+func (e *MarshalError) Unwrap() error {
+	return e.Err
+}
+
+// A payload's JSON is longer than Limit bytes.
+type PayloadTooLargeError struct {
+	Payload []byte
+	Limit   int
+	// Size of the aps dictionary, and of everything else: the custom keys
+	// with their values, the "aps" key and the enclosing object.
+	ApsBytes    int
+	CustomBytes int
+}
+
+func (e *PayloadTooLargeError) Error() string {
+	return fmt.Sprintf("payload json too large (aps %d bytes, custom %d bytes): %s", e.ApsBytes, e.CustomBytes, string(e.Payload))
+}
+
 type NotificationError struct {
 	Command    uint8
 	Status     uint8
 	Identifier uint32
 
 	OtherError error
+
+	// generation of the connection the error was read from, used to drop
+	// errors belonging to an already-closed connection.
+	generation uint32
+	// notification the error response refers to, if it is still known.
+	notification *Notification
+	// trailing characters of the token DeviceToken shows, all of it if 0.
+	tokenShown int
+}
+
+// A notification Apple rejected and Apn won't resend, see WithDeadLetterChan.
+type DeadLetter struct {
+	Notification *Notification
+	// Status Apple rejected the notification with, e.g. 8 for an invalid
+	// token.
+	Status uint8
+	// The NotificationError Apple replied with.
+	Reason error
 }
 
 // Make a new NotificationError with error response p and error err.
@@ -29,6 +169,52 @@ func NewNotificationError(p []byte, err error) (e NotificationError) {
 	return
 }
 
+// Report whether the connection failed, connecting, reading from or writing
+// to it, rather than a notification being rejected, by Apple or before
+// being sent.
+func (e NotificationError) IsConnectionError() bool {
+	if e.OtherError == nil {
+		return false
+	}
+	var c *connectionError
+	return e.notification == nil || errors.As(e.OtherError, &c)
+}
+
+// The notification the error refers to: the one that failed to send, or the
+// one Apple rejected, looked up by identifier among the ones in flight. Nil
+// for connection errors and when it isn't known anymore, e.g. when Apple
+// replied after its connection was replaced.
+func (e NotificationError) Notification() *Notification {
+	return e.notification
+}
+
+// The device token of the notification the error refers to, redacted to
+// its last characters with WithTokenRedaction. Empty if the notification
+// isn't known anymore.
+func (e NotificationError) DeviceToken() string {
+	if e.notification == nil {
+		return ""
+	}
+	return redactToken(e.notification.DeviceToken, e.tokenShown)
+}
+
+// Token with only its last shown characters, all of it if shown is 0.
+func redactToken(token string, shown int) string {
+	if shown <= 0 || shown >= len(token) {
+		return token
+	}
+	return "..." + token[len(token)-shown:]
+}
+
+// The Meta of the notification the error refers to, nil if it isn't known
+// anymore.
+func (e NotificationError) Meta() interface{} {
+	if e.notification == nil {
+		return nil
+	}
+	return e.notification.Meta
+}
+
 func (e NotificationError) Error() string {
 	if e.OtherError != nil {
 		return e.OtherError.Error()
@@ -62,6 +248,18 @@ func (e NotificationError) Error() string {
 	return fmt.Sprintf("%s(%d): id(%x)", status, e.Status, e.Identifier)
 }
 
+// Error responses always have command 8; anything else unwraps to
+// ErrMalformedResponse.
+func (e NotificationError) Unwrap() error {
+	if e.OtherError != nil {
+		return e.OtherError
+	}
+	if e.Command != 8 {
+		return ErrMalformedResponse
+	}
+	return nil
+}
+
 func (e NotificationError) String() string {
 	return e.Error()
 }
@@ -1,6 +1,7 @@
 package apns
 
 import (
+	"errors"
 	"io"
 	"testing"
 )
@@ -75,3 +76,65 @@ func TestNotificationError(t *testing.T) {
 		}
 	}
 }
+
+func TestMalformedResponse(t *testing.T) {
+	{
+		e := NewNotificationError([]byte{9, 8, 0, 0, 0, 1}, nil)
+		if !errors.Is(e, ErrMalformedResponse) {
+			t.Errorf("command 9 should be a malformed response")
+		}
+	}
+
+	{
+		e := NewNotificationError([]byte{8, 8, 0, 0, 0, 1}, nil)
+		if errors.Is(e, ErrMalformedResponse) {
+			t.Errorf("command 8 shouldn't be a malformed response")
+		}
+	}
+
+	{
+		e := NewNotificationError(nil, io.EOF)
+		if !errors.Is(e, io.EOF) {
+			t.Errorf("got: %s, expect to unwrap to EOF", e)
+		}
+	}
+}
+
+func TestIsConnectionError(t *testing.T) {
+	n := &Notification{DeviceToken: "aa"}
+	local := NewNotificationError(nil, ErrTokenFiltered)
+	local.notification = n
+	write := NewNotificationError(nil, &connectionError{errors.New("write socket error: broken pipe")})
+	write.notification = n
+	for _, c := range []struct {
+		e      NotificationError
+		expect bool
+	}{
+		{NewNotificationError([]byte{8, 8, 0, 0, 0, 1}, nil), false},
+		{NewNotificationError(nil, io.EOF), true},
+		{NewNotificationError(nil, ErrConnectionRefusedByApple), true},
+		{local, false},
+		{write, true},
+	} {
+		if got := c.e.IsConnectionError(); got != c.expect {
+			t.Errorf("%s: got: %t, expect: %t", c.e, got, c.expect)
+		}
+	}
+}
+
+func TestNotificationErrorDeviceToken(t *testing.T) {
+	n := &Notification{DeviceToken: "aabbccdd"}
+	for _, c := range []struct {
+		e      NotificationError
+		expect string
+	}{
+		{NotificationError{}, ""},
+		{NotificationError{notification: n}, "aabbccdd"},
+		{NotificationError{notification: n, tokenShown: 4}, "...ccdd"},
+		{NotificationError{notification: n, tokenShown: 8}, "aabbccdd"},
+	} {
+		if got := c.e.DeviceToken(); got != c.expect {
+			t.Errorf("got: %s, expect: %s", got, c.expect)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package apns
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"strings"
+)
+
+// Apple's binary gateways.
+const (
+	SandboxGateway    = "gateway.sandbox.push.apple.com:2195"
+	ProductionGateway = "gateway.push.apple.com:2195"
+
+	// VoIP pushes go through the same gateways, sent with a VoIP Services
+	// certificate.
+	SandboxVoIPGateway    = SandboxGateway
+	ProductionVoIPGateway = ProductionGateway
+)
+
+// Push types, as used by Apple's HTTP/2 API.
+const (
+	PushTypeAlert = "alert"
+	PushTypeVoIP  = "voip"
+	PushTypeMDM   = "mdm"
+)
+
+// Topics ending in this are VoIP topics.
+const voipTopicSuffix = ".voip"
+
+// Extension Apple puts in certificates allowed to send VoIP pushes.
+var voipExtension = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 3, 6}
+
+// Pick the push type for topic, checking that the PEM encoded certificate
+// can send VoIP pushes when topic is a VoIP topic.
+func PushTypeForTopic(certPEMBlock []byte, topic string) (string, error) {
+	if !strings.HasSuffix(topic, voipTopicSuffix) {
+		return PushTypeAlert, nil
+	}
+	block, _ := pem.Decode(certPEMBlock)
+	if block == nil {
+		return "", errors.New("no certificate found in PEM data")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	if !supportsVoIP(cert) {
+		return "", ErrNotVoIPCertificate
+	}
+	return PushTypeVoIP, nil
+}
+
+func supportsVoIP(cert *x509.Certificate) bool {
+	if strings.HasPrefix(cert.Subject.CommonName, "VoIP Services:") {
+		return true
+	}
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(voipExtension) {
+			return true
+		}
+	}
+	return false
+}
+
+// The environment of server, for logging: "sandbox", "production", or
+// "custom" for anything but Apple's gateways.
+func environment(server string) string {
+	switch server {
+	case SandboxGateway:
+		return "sandbox"
+	case ProductionGateway:
+		return "production"
+	}
+	return "custom"
+}
+
+// Subject attribute Apple puts the topic (bundle ID) of a push certificate in.
+var uidAttribute = asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 1}
+
+// The topic cert sends to, from its UID or else from a common name like
+// "Apple Push Services: com.example.app". Empty if it has neither.
+func certTopic(cert *x509.Certificate) string {
+	for _, name := range cert.Subject.Names {
+		if uid, ok := name.Value.(string); ok && name.Type.Equal(uidAttribute) {
+			return uid
+		}
+	}
+	if i := strings.Index(cert.Subject.CommonName, ": "); i >= 0 {
+		return cert.Subject.CommonName[i+2:]
+	}
+	return ""
+}
@@ -0,0 +1,58 @@
+package apns
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+)
+
+func TestPushTypeForTopic(t *testing.T) {
+	plain, _ := testCertificateNamed(t, "Apple Push Services: com.example.app")
+	voip, _ := testCertificateNamed(t, "VoIP Services: com.example.app")
+
+	for _, c := range []struct {
+		cert   []byte
+		topic  string
+		expect string
+		err    error
+	}{
+		{plain, "com.example.app", PushTypeAlert, nil},
+		{plain, "com.example.app.voip", "", ErrNotVoIPCertificate},
+		{voip, "com.example.app.voip", PushTypeVoIP, nil},
+	} {
+		got, err := PushTypeForTopic(c.cert, c.topic)
+		if got != c.expect || err != c.err {
+			t.Errorf("%s: got: %s, %v, expect: %s, %v", c.topic, got, err, c.expect, c.err)
+		}
+	}
+}
+
+func TestEnvironmentAndTopic(t *testing.T) {
+	for server, expect := range map[string]string{
+		SandboxGateway:    "sandbox",
+		ProductionGateway: "production",
+		"127.0.0.1:2195":  "custom",
+	} {
+		if got := environment(server); got != expect {
+			t.Errorf("%s got: %s, expect: %s", server, got, expect)
+		}
+	}
+
+	for _, c := range []struct {
+		commonName string
+		expect     string
+	}{
+		{"Apple Push Services: com.example.app", "com.example.app"},
+		{"127.0.0.1", ""},
+	} {
+		certPEM, _ := testCertificateNamed(t, c.commonName)
+		block, _ := pem.Decode(certPEM)
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatalf("can't parse certificate: %s", err)
+		}
+		if got := certTopic(cert); got != c.expect {
+			t.Errorf("%s got: %s, expect: %s", c.commonName, got, c.expect)
+		}
+	}
+}
@@ -0,0 +1,492 @@
+package apns
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"time"
+)
+
+// An Option configures an Apn made by NewWithOptions.
+type Option func(*Apn)
+
+// Anything able to log, like a *log.Logger.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Anything able to log structured events, e.g. as JSON, see
+// WithStructuredLogger.
+type StructuredLogger interface {
+	Log(level string, fields map[string]interface{})
+}
+
+// What to do with an error when ErrorChan is full.
+type ErrorChanPolicy int
+
+const (
+	// Wait until the error is read. Sending stalls while nobody reads
+	// ErrorChan, so either keep reading it or pick another policy.
+	Block ErrorChanPolicy = iota
+	// Drop the error that doesn't fit.
+	DropNewest
+	// Drop the oldest buffered error to make room. Without a buffer there's
+	// nothing to drop but the new error.
+	DropOldest
+)
+
+// What SendBatch does after a notification fails to send locally, e.g. a bad
+// token or a write error. Errors Apple reports don't apply, see
+// WithBatchPolicy.
+type BatchPolicy int
+
+const (
+	// Don't send the rest of the batch, they get ErrNotAttempted.
+	StopOnSendError BatchPolicy = iota
+	// Go on sending the rest of the batch.
+	ContinueOnSendError
+)
+
+// Expire content-available background pushes that set no expiry of their
+// own after expiry, instead of right away like other notifications, so
+// Apple keeps them for a device that's briefly offline. A push that also
+// shows an alert or plays a sound is an alert push and isn't affected; one
+// that only also sets the badge is. The default is 0, right away.
+func WithBackgroundExpiry(expiry time.Duration) Option {
+	return func(a *Apn) {
+		a.bgExpiry = expiry
+	}
+}
+
+// Close the connection after idling for timeout. A timeout of 0 (the default)
+// keeps it open until an error closes it.
+func WithTimeout(timeout time.Duration) Option {
+	return func(a *Apn) {
+		a.timeout = int64(timeout)
+	}
+}
+
+// Give up the TLS handshake after timeout, failing with ErrHandshakeTimeout,
+// to tell a stalled handshake from a slow connect. It applies from when the
+// TCP connection is made and replaces the WithDialTimeout timeout for the
+// handshake. The default is no separate handshake timeout.
+func WithHandshakeTimeout(timeout time.Duration) Option {
+	return func(a *Apn) {
+		a.tlsTimeout = timeout
+	}
+}
+
+// Fail a write to the connection that blocks for longer than timeout, e.g.
+// because the network stopped carrying data, and reconnect on the next send
+// instead of writing to the dead connection. The default is no timeout.
+func WithWriteTimeout(timeout time.Duration) Option {
+	return func(a *Apn) {
+		a.writeTimeout = timeout
+	}
+}
+
+// Keep an idle connection open for grace longer than the WithTimeout timeout,
+// so the trailing sends of a loose burst still reuse it. Each send restarts
+// the wait. The grace stays when the timeout is changed with SetIdleTimeout,
+// and doesn't apply without a timeout.
+func WithIdleGrace(grace time.Duration) Option {
+	return func(a *Apn) {
+		a.idleGrace = grace
+	}
+}
+
+// Give up connecting to the server after timeout. The default is no timeout.
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(a *Apn) {
+		a.dialTimeout = timeout
+	}
+}
+
+// Probe the connection every interval while it's idle, so a connection a NAT
+// or firewall silently dropped fails (and is redialed on the next send)
+// instead of swallowing the next notification. The binary protocol has no
+// ping, so the probe is a TCP keepalive: it proves the path to Apple is alive,
+// not that Apple is still reading. With WithDialFunc it only applies if dial
+// returns a *net.TCPConn. The default is Go's keepalive period.
+func WithIdlePing(interval time.Duration) Option {
+	return func(a *Apn) {
+		a.idlePing = interval
+	}
+}
+
+// Keep at most n notifications in flight on a connection, failing sends
+// beyond that with ErrInFlightFull. Apple never confirms a notification, so
+// they're only cleared when the connection closes: after idling for the
+// WithTimeout timeout, on an error from Apple, or on Reconnect. Without a
+// timeout, call Reconnect when sends fail with ErrInFlightFull. The default is
+// no limit.
+func WithMaxInFlight(n int) Option {
+	return func(a *Apn) {
+		a.maxInFlight = n
+	}
+}
+
+// Buffer up to size bytes of notifications and write them to the connection
+// together, saving a write per notification at high send rates. The buffer is
+// written when it fills, when WithFlushInterval has passed since the first
+// notification in it, and before the connection closes. A send only fails on
+// write errors when its own write reaches the connection; a failed flush is
+// reported on ErrorChan, or returned by Close. The default is no buffer.
+func WithWriteBufferSize(size int) Option {
+	return func(a *Apn) {
+		a.writeBufferSize = size
+	}
+}
+
+// With a write buffer, write buffered notifications at most interval after
+// the first of them. With the default 0 they're written as soon as the sender
+// isn't busy, so only notifications sent concurrently share a write.
+func WithFlushInterval(interval time.Duration) Option {
+	return func(a *Apn) {
+		a.flushInterval = interval
+	}
+}
+
+// Drop notifications that waited longer than age to be picked up for sending,
+// e.g. behind a slow connect, failing them with ErrStale instead of sending
+// them late. The default is no limit.
+func WithMaxQueueAge(age time.Duration) Option {
+	return func(a *Apn) {
+		a.maxQueueAge = age
+	}
+}
+
+// Replace the connection after n notifications were sent on it, so no single
+// connection lives forever. The connection is closed right after the nth
+// send and the next notification makes a new one. Like with Reconnect, errors
+// Apple reports on the old connection after it closed are dropped. The
+// default is no limit.
+func WithMaxSendsPerConnection(n int) Option {
+	return func(a *Apn) {
+		a.maxSendsPerConn = n
+	}
+}
+
+// Send name as the TLS server name (SNI) and verify the server's certificate
+// against it, e.g. behind a load balancer whose address doesn't match the
+// certificate. The default is the host of the server address.
+func WithServerName(name string) Option {
+	return func(a *Apn) {
+		a.conf.ServerName = name
+	}
+}
+
+// Verify the server's certificate against roots only, instead of the system
+// roots, e.g. to pin the certificate authority of Apple's servers.
+func WithRootCAs(roots *x509.CertPool) Option {
+	return func(a *Apn) {
+		a.conf.RootCAs = roots
+	}
+}
+
+// Fail sending a RawPayload without an aps key with ErrMissingAps, instead of
+// only requiring a JSON object. Leave it off for MDM pushes and SetApsKey
+// payloads, which have no aps key.
+func WithStrictRawPayload() Option {
+	return func(a *Apn) {
+		a.strictRaw = true
+	}
+}
+
+// Fail sending a Payload whose custom keys collide with Apple's with the
+// *ReservedKeyError of Payload.CheckCustomKeys, instead of dropping a custom
+// "aps" key and sending the others.
+func WithStrictCustomKeys() Option {
+	return func(a *Apn) {
+		a.strictKeys = true
+	}
+}
+
+// Set TCP_NODELAY on the connection to noDelay, so small frames are written
+// right away instead of waiting to be coalesced by Nagle's algorithm. The
+// default is true. With WithDialFunc it only applies if dial returns a
+// *net.TCPConn.
+func WithNoDelay(noDelay bool) Option {
+	return func(a *Apn) {
+		a.nagle = !noDelay
+	}
+}
+
+// Dial the server over network: "tcp4" for IPv4 only, "tcp6" for IPv6 only,
+// e.g. when one of them is broken where Apn runs. The default "tcp" tries
+// the server's addresses in turn, racing IPv6 against IPv4, with the
+// WithDialTimeout timeout split between them so an unreachable address
+// doesn't use it up. The dial of WithDialFunc gets network.
+func WithNetwork(network string) Option {
+	return func(a *Apn) {
+		a.network = network
+	}
+}
+
+// Connect to the server from addr, e.g. a *net.TCPAddr to send from a
+// specific interface or port. The default lets the OS choose. It doesn't
+// apply to WithDialFunc.
+func WithLocalAddr(addr net.Addr) Option {
+	return func(a *Apn) {
+		a.localAddr = addr
+	}
+}
+
+// Connect to the server with dial instead of net.Dial, e.g. to bind a source
+// address or to hand out in-memory connections in tests. WithDialTimeout
+// doesn't apply to dial.
+func WithDialFunc(dial func(network, addr string) (net.Conn, error)) Option {
+	return func(a *Apn) {
+		a.dial = dial
+	}
+}
+
+// Call onConnect with the TLS state of every new connection, right after the
+// handshake and before anything is sent on it. It runs on the sending
+// goroutine, so sending waits for it to return.
+func WithOnConnect(onConnect func(state tls.ConnectionState)) Option {
+	return func(a *Apn) {
+		a.onConnect = onConnect
+	}
+}
+
+// Call onDropped for every notification Apn gives up on, with the reason:
+// ErrStale, ErrInFlightFull, ErrTokenFiltered, ErrAborted, or the
+// NotificationError Apple rejected it with and that wasn't retried, see
+// WithClassifier. Sends that
+// fail for other reasons, like invalid tokens or write errors, only return
+// their error. It runs on the sending goroutine, so sending waits for it to
+// return.
+func WithOnDropped(onDropped func(n *Notification, reason error)) Option {
+	return func(a *Apn) {
+		a.onDropped = onDropped
+	}
+}
+
+// Show only the last show characters of the device token a
+// NotificationError's DeviceToken returns, e.g. 4 for logs. The default, or
+// a show of 0, shows all of it.
+func WithTokenRedaction(show int) Option {
+	return func(a *Apn) {
+		a.tokenShown = show
+	}
+}
+
+// Deliver the notifications Apple rejected and that won't be resent, such as
+// invalid tokens or payloads too large, to DeadLetterChan, buffering up to
+// size of them. Unlike ErrorChan it's never required reading: a dead letter
+// that doesn't fit is dropped and counted in DroppedErrors.
+func WithDeadLetterChan(size int) Option {
+	return func(a *Apn) {
+		a.deadLetterSize = size
+	}
+}
+
+// Send the notifications onReconnect returns first on every connection after
+// the first, before the ones waiting to be sent, e.g. to restore a badge
+// count. Their failures go to ErrorChan. It runs on the sending goroutine:
+// sending from it deadlocks.
+func WithOnReconnect(onReconnect func() []*Notification) Option {
+	return func(a *Apn) {
+		a.onReconnect = onReconnect
+	}
+}
+
+// Call onRawRead with the bytes of every read from the connection before they
+// are parsed, e.g. to debug a response the parser doesn't expect. Apple's
+// error responses are 6 bytes, a short read gets what was read. It runs on
+// the goroutine reading the connection, and p is the callee's to keep.
+func WithOnRawRead(onRawRead func(p []byte)) Option {
+	return func(a *Apn) {
+		a.onRawRead = onRawRead
+	}
+}
+
+// Log connects and connection failures to logger.
+func WithLogger(logger Logger) Option {
+	return func(a *Apn) {
+		a.logger = logger
+	}
+}
+
+// Log an event to logger on every connect, reconnect, send, error and drop.
+// Each event's fields have its name under "event" and, as far as they
+// apply, "server", "token" (redacted like WithTokenRedaction makes
+// NotificationError's), "identifier", "status", "error" and "latency_ms":
+// how long the connect took, or the send from being queued. Sends log at
+// level "debug", drops at "warn", errors at "error" and the rest at "info".
+// It runs on the goroutine the event happens on.
+func WithStructuredLogger(logger StructuredLogger) Option {
+	return func(a *Apn) {
+		a.events = logger
+	}
+}
+
+// Reject payloads longer than n bytes instead of the default 256. The limit
+// counts the bytes of the payload JSON only, not the token, identifier, expiry
+// or length prefixes framing it, so a payload of exactly n bytes is sent.
+func WithMaxPayloadBytes(n int) Option {
+	return func(a *Apn) {
+		a.maxPayloadBytes = n
+	}
+}
+
+// Apply policy to errors that don't fit in ErrorChan. The default is Block,
+// which stalls sending while nobody reads ErrorChan.
+func WithErrorChanPolicy(policy ErrorChanPolicy) Option {
+	return func(a *Apn) {
+		a.errorChanPolicy = policy
+	}
+}
+
+// Buffer up to size errors in ErrorChan. The default is no buffer.
+func WithErrorChanBufferSize(size int) Option {
+	return func(a *Apn) {
+		a.errorChanBufferSize = size
+	}
+}
+
+// Apply policy to SendBatch when a notification fails to send. The default
+// is StopOnSendError. The policy only sees failures to send: Apple never
+// confirms a notification, so its errors arrive on ErrorChan after the
+// notification was sent, usually after SendBatch returned. Apn then always
+// reconnects and resends the rest of the batch Apple dropped after the
+// rejected notification, whatever the policy.
+func WithBatchPolicy(policy BatchPolicy) Option {
+	return func(a *Apn) {
+		a.batchPolicy = policy
+	}
+}
+
+// Decide with classify what to do with notifications Apple reports errors
+// for, instead of DefaultClassify. Retry resends a notification once, right
+// before the ones Apple dropped after it; its error is still reported.
+// RemoveToken has a Service pass the token to onInvalidToken instead of
+// the error to onError. Apn and Service only classify error responses from
+// Apple, not local errors like failed writes; classify runs on the sending
+// goroutine and on the Service's.
+func WithClassifier(classify func(err error) Disposition) Option {
+	return func(a *Apn) {
+		a.classifier = classify
+	}
+}
+
+// Hold badge-only notifications back for window, sending only the latest
+// one per device token when it ends. Other notifications are sent right
+// away, after any badge update waiting for the same token.
+func WithCoalesceBadgeUpdates(window time.Duration) Option {
+	return func(a *Apn) {
+		a.coalesceWindow = window
+	}
+}
+
+// Log a warning for every payload longer than n bytes that is still within
+// the payload limit, to notice payloads growing towards it, e.g. with n at 90%
+// of the limit. The default is no warning.
+func WithPayloadWarnThreshold(n int) Option {
+	return func(a *Apn) {
+		a.payloadWarnAt = n
+	}
+}
+
+// Send notifications in the framed format (command 2), which carries each
+// notification's Priority, instead of the enhanced format (command 1).
+func WithFramedFormat() Option {
+	return WithProtocolCommand(CommandFramed)
+}
+
+// Send notifications with command, CommandEnhanced (the default) or
+// CommandFramed. NewWithOptions fails with ErrUnsupportedCommand for others.
+func WithProtocolCommand(command uint8) Option {
+	return func(a *Apn) {
+		a.command = command
+	}
+}
+
+// Connect in NewWithOptions and fail it if that fails, instead of connecting
+// on the first send.
+func WithEagerConnect() Option {
+	return func(a *Apn) {
+		a.eagerConnect = true
+	}
+}
+
+// Send a Payload too large for the WithMaxPayloadBytes limit with its alert
+// body shortened to fit, see Payload.TruncateBody, instead of failing with a
+// PayloadTooLargeError. The notification's own Payload isn't changed. One
+// that doesn't fit even without its body still fails.
+func WithTruncateBody() Option {
+	return func(a *Apn) {
+		a.truncateBody = true
+	}
+}
+
+// Bound each of Shutdown's waits, for the queued sends and for Apple's error
+// responses, by timeout, independently of Shutdown's context. The default is
+// 5 seconds.
+func WithDrainTimeout(timeout time.Duration) Option {
+	return func(a *Apn) {
+		a.drainTimeout = timeout
+	}
+}
+
+// Connect again as soon as the connection idles out, instead of on the next
+// send, so a send never waits for the dial and handshake. The connection is
+// replaced after every idle timeout until Close; without a timeout it's
+// never closed for idling anyway. Warming failures go to ErrorChan.
+func WithWarmConnection() Option {
+	return func(a *Apn) {
+		a.warm = true
+	}
+}
+
+// Send to each device token at most n times per per, in bursts of up to n,
+// e.g. to protect devices from a flood of notifications caused by a bug.
+// Sends beyond that wait their turn if wait is set, until their context is
+// done, and fail with ErrTokenRateLimited otherwise. Only the most recently
+// sent to tokens are tracked, so memory stays bounded. An n or per of 0 (or
+// less) sets no limit.
+func WithTokenRateLimit(n int, per time.Duration, wait bool) Option {
+	return func(a *Apn) {
+		a.tokenLimiter = nil
+		if n > 0 && per > 0 {
+			a.tokenLimiter = newTokenLimiter(n, per, wait)
+		}
+	}
+}
+
+// Only send to device tokens filter returns true for, failing sends to others
+// with ErrTokenFiltered, e.g. to allow nothing but test devices in staging.
+// filter runs on the sending goroutine, so sending waits for it to return.
+func WithTokenFilter(filter func(token string) bool) Option {
+	return func(a *Apn) {
+		a.tokenFilter = filter
+	}
+}
+
+// Never connect or write anything: Send does all the encoding and checks of a
+// real send and returns their error, if any, but nothing is transmitted.
+func WithDryRun() Option {
+	return func(a *Apn) {
+		a.dryRun = true
+	}
+}
+
+func (a *Apn) logf(format string, v ...interface{}) {
+	if a.logger != nil {
+		a.logger.Printf(format, v...)
+	}
+}
+
+// Log event to the WithStructuredLogger logger, with fields.
+func (a *Apn) logEvent(level, event string, fields map[string]interface{}) {
+	if a.events == nil {
+		return
+	}
+	fields["event"] = event
+	a.events.Log(level, fields)
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
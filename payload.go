@@ -2,8 +2,26 @@ package apns
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
 )
 
+// Marshals payloads, see SetJSONMarshaler.
+var marshalJSON = json.Marshal
+
+// Marshal payloads with marshal instead of encoding/json's json.Marshal, e.g. a
+// faster JSON library. It must produce the same JSON and is used for the whole
+// payload, custom data included. A nil marshal restores json.Marshal. Call it
+// before sending, it isn't safe to change while payloads are marshaled.
+func SetJSONMarshaler(marshal func(v interface{}) ([]byte, error)) {
+	if marshal == nil {
+		marshal = json.Marshal
+	}
+	marshalJSON = marshal
+}
+
 type AlertDictionary struct {
 	Body          string   `json:"body,omitempty"`
 	LockKey       string   `json:"loc-key,omitempty"`
@@ -12,24 +30,211 @@ type AlertDictionary struct {
 	LaunchImage   string   `json:"launch-image,omitempty"`
 }
 
-// If AlertStruct set to any instance, it will ignore any content in Alert when send to iOS.
-// To use simple string Alert, make sure AlertStruct's value is nil.
+// Report whether d has fields only the dictionary form of the alert carries.
+func (d *AlertDictionary) localized() bool {
+	return d != nil && (d.LockKey != "" || len(d.LockArgs) > 0 || d.ActionLockKey != "" || d.LaunchImage != "")
+}
+
+// Marshal the dictionary, failing when LockArgs are set without a LockKey to
+// format them with.
+func (d AlertDictionary) MarshalJSON() ([]byte, error) {
+	if len(d.LockArgs) > 0 && d.LockKey == "" {
+		return nil, errors.New("loc-args set without loc-key")
+	}
+	type alertDictionary AlertDictionary
+	return json.Marshal(alertDictionary(d))
+}
+
+// The alert is sent as a dictionary if AlertDictionary has any field a plain
+// string can't carry (loc-key, loc-args, action-loc-key or launch-image) or
+// ForceAlertDict is set, and as a plain string of the body otherwise. The
+// body is AlertDictionary's Body if set, else AlertString.
+//
+// Set ContentAvailable for a background push waking the app, see
+// WithBackgroundExpiry.
+//
+// The keys are marshaled in a fixed order: alert, badge, sound,
+// content-available. Within an
+// alert dictionary it's body, loc-key, loc-args, action-loc-key, launch-image.
+//
+// An empty Sound means no sound key at all. Set Silent to send an explicitly
+// empty sound instead, ignoring Sound.
 type Aps struct {
-	// AlertDictionary AlertDictionary `json:"alert,omitempty"`
-	AlertString string `json:"alert,omitempty"`
-	Badge       int    `json:"badge,omitempty"`
-	Sound       string `json:"sound,omitempty"`
+	AlertDictionary *AlertDictionary `json:"-"`
+	AlertString     string           `json:"alert,omitempty"`
+	ForceAlertDict  bool             `json:"-"`
+	Badge           int              `json:"badge,omitempty"`
+	Sound           string           `json:"sound,omitempty"`
+	Silent          bool             `json:"-"`
+	// sent as "content-available":1. With a Badge too, the push updates the
+	// badge in the background; with an alert or sound it's an alert push.
+	ContentAvailable bool `json:"-"`
+}
+
+// Sound of the default alert.
+const SoundDefault = "default"
+
+// The alert body sent: AlertDictionary's Body if set, else AlertString.
+func (a Aps) body() string {
+	if d := a.AlertDictionary; d != nil && d.Body != "" {
+		return d.Body
+	}
+	return a.AlertString
+}
+
+func (a Aps) MarshalJSON() ([]byte, error) {
+	type aps Aps
+	// alert and sound shadow the embedded ones, keeping their order
+	v := struct {
+		Alert interface{} `json:"alert,omitempty"`
+		aps
+		Sound            *string `json:"sound,omitempty"`
+		ContentAvailable int     `json:"content-available,omitempty"`
+	}{aps: aps(a)}
+	if a.ContentAvailable {
+		v.ContentAvailable = 1
+	}
+	body := a.body()
+	if a.ForceAlertDict || a.AlertDictionary.localized() {
+		d := AlertDictionary{}
+		if a.AlertDictionary != nil {
+			d = *a.AlertDictionary
+		}
+		d.Body = body
+		v.Alert = d
+	} else if body != "" {
+		v.Alert = body
+	}
+	if a.Silent {
+		v.Sound = new(string)
+	} else if a.Sound != "" {
+		v.Sound = &a.Sound
+	}
+	return json.Marshal(v)
 }
 
+// A Payload can be shared by concurrent sends, e.g. of a broadcast, as long
+// as nobody changes it until they return. Changing it after that doesn't
+// change what is sent: a notification Apple dropped is resent with the
+// payload bytes first sent, and a held back badge update is copied.
+//
+// An all-zero Payload marshals to {"aps":{}}, which Send rejects with
+// ErrEmptyAlertPayload. The binary protocol has no push type: a background
+// notification is one with Aps.ContentAvailable set, which marshals to
+// {"aps":{"content-available":1}}.
 type Payload struct {
 	Aps Aps
 
 	customProperty map[string]interface{}
+	customData     interface{}
+	mdm            string
+	apsKey         string
+	apsCustom      bool // SetCustom("aps") was called
+}
+
+// New payload waking an MDM enrolled device with its push magic. It marshals
+// to {"mdm":magic} only: MDM pushes have no aps dictionary or custom keys.
+func NewMDMPayload(magic string) *Payload {
+	return &Payload{mdm: magic}
 }
 
-// Set a custom key with value, overwriting any existed key. If key is "aps", do nothing.
+// Copy of the payload sharing nothing with it but the SetCustomData data and
+// the custom values themselves.
+func (l *Payload) clone() *Payload {
+	p := *l
+	if l.Aps.AlertDictionary != nil {
+		d := *l.Aps.AlertDictionary
+		d.LockArgs = append([]string(nil), d.LockArgs...)
+		p.Aps.AlertDictionary = &d
+	}
+	if l.customProperty != nil {
+		p.customProperty = make(map[string]interface{}, len(l.customProperty))
+		for k, v := range l.customProperty {
+			p.customProperty[k] = v
+		}
+	}
+	return &p
+}
+
+// Report whether the payload has nothing Apple acts on: no alert, badge or
+// sound, and isn't content-available or for MDM. Custom keys alone don't
+// count, the app only gets them along with one of those.
+func (l *Payload) empty() bool {
+	a := l.Aps
+	return l.mdm == "" && a.AlertString == "" && a.AlertDictionary == nil && !a.ForceAlertDict &&
+		a.Badge == 0 && a.Sound == "" && !a.Silent && !a.ContentAvailable
+}
+
+// Report whether the payload alerts the user: shows an alert or plays a
+// sound. Updating the badge alone doesn't.
+func (l *Payload) alerts() bool {
+	a := l.Aps
+	return a.AlertString != "" || a.AlertDictionary != nil || a.ForceAlertDict || a.Sound != ""
+}
+
+// Marshal the aps dictionary under name instead of "aps". Apple only reads
+// "aps", this is for relays in front of it that expect the dictionary under
+// another key. An empty name restores "aps".
+func (l *Payload) SetApsKey(name string) {
+	l.apsKey = name
+}
+
+// Keys of the aps dictionary. Custom keys named like them are allowed, but
+// likely meant to go in the aps dictionary.
+var apsKeys = []string{"alert", "badge", "sound", "content-available"}
+
+// Check the custom keys for ones colliding with Apple's: an "aps" key, which
+// is dropped, or one named like a key of the aps dictionary, which is sent
+// but not read by Apple. Returns a *ReservedKeyError for the first found.
+// See WithStrictCustomKeys to check when sending.
+func (l *Payload) CheckCustomKeys() error {
+	if l.apsCustom {
+		return &ReservedKeyError{Key: "aps"}
+	}
+	if l.customData != nil {
+		var data map[string]json.RawMessage
+		if j, err := marshalJSON(l.customData); err == nil && json.Unmarshal(j, &data) == nil {
+			if _, ok := data["aps"]; ok {
+				return &ReservedKeyError{Key: "aps"}
+			}
+		}
+	}
+	custom := l.Custom()
+	for _, key := range apsKeys {
+		if _, ok := custom[key]; ok {
+			return &ReservedKeyError{Key: key}
+		}
+	}
+	return nil
+}
+
+// Set data marshaling to a JSON object whose keys are sent as custom keys,
+// e.g. a struct with json tags. Keys set with SetCustom take precedence, and
+// an "aps" key is ignored.
+func (l *Payload) SetCustomData(data interface{}) {
+	l.customData = data
+}
+
+// New payload with aps and the keys of custom as its custom keys, like
+// SetCustomData, failing if custom doesn't marshal to a JSON object. A nil
+// custom adds none.
+func PayloadFrom(aps Aps, custom interface{}) (*Payload, error) {
+	p := &Payload{Aps: aps}
+	if custom == nil {
+		return p, nil
+	}
+	p.SetCustomData(custom)
+	if _, err := p.MarshalJSON(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Set a custom key with value, overwriting any existed key. If key is "aps", do nothing,
+// but CheckCustomKeys reports it.
 func (l *Payload) SetCustom(key string, value interface{}) {
 	if key == "aps" {
+		l.apsCustom = true
 		return
 	}
 	if l.customProperty == nil {
@@ -50,10 +255,180 @@ func (l *Payload) GetCustom(key string) interface{} {
 	return l.customProperty[key]
 }
 
+// The alert text sent, AlertDictionary's Body if set, else AlertString; ""
+// if neither is set.
+func (l *Payload) Alert() string {
+	return l.Aps.body()
+}
+
+// The badge, 0 if none is set.
+func (l *Payload) Badge() int {
+	return l.Aps.Badge
+}
+
+// A copy of the custom keys with their values, as they're sent: the keys of
+// SetCustomData as json.RawMessage, unless it doesn't marshal, overridden by
+// the ones set with SetCustom. Changing it doesn't change the payload.
+func (l *Payload) Custom() map[string]interface{} {
+	custom := make(map[string]interface{})
+	if l.customData != nil {
+		var data map[string]json.RawMessage
+		if j, err := marshalJSON(l.customData); err == nil && json.Unmarshal(j, &data) == nil {
+			for k, v := range data {
+				if k != "aps" {
+					custom[k] = v
+				}
+			}
+		}
+	}
+	for k, v := range l.customProperty {
+		custom[k] = v
+	}
+	return custom
+}
+
+// Send an empty alert dictionary, "alert":{}, clearing the alert set so far.
+// Unlike no alert at all, it shows the system's generic alert.
+func (l *Payload) SetEmptyAlert() {
+	l.Aps.AlertString = ""
+	l.Aps.AlertDictionary = nil
+	l.Aps.ForceAlertDict = true
+}
+
+// Render an alert from template, replacing every {name} placeholder with
+// vars[name]. Placeholders missing from vars are left as they are, see
+// SetAlertTemplate to fail on them instead. Write {{ and }} for literal
+// braces. The result is JSON escaped when the payload is marshaled, vars
+// need no escaping.
+func RenderAlert(template string, vars map[string]string) string {
+	alert, _ := renderAlert(template, vars, false)
+	return alert
+}
+
+// Set the alert to template rendered with vars like RenderAlert does,
+// failing with ErrMissingTemplateVar for a placeholder missing from vars.
+// The alert is left unchanged then.
+func (l *Payload) SetAlertTemplate(template string, vars map[string]string) error {
+	alert, err := renderAlert(template, vars, true)
+	if err != nil {
+		return err
+	}
+	l.Aps.AlertString = alert
+	return nil
+}
+
+func renderAlert(template string, vars map[string]string, strict bool) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(template); i++ {
+		c := template[i]
+		if (c == '{' || c == '}') && i+1 < len(template) && template[i+1] == c {
+			b.WriteByte(c)
+			i++
+			continue
+		}
+		end := strings.IndexAny(template[i+1:], "{}")
+		if c != '{' || end < 0 || template[i+1+end] != '}' {
+			b.WriteByte(c)
+			continue
+		}
+		name := template[i+1 : i+1+end]
+		value, ok := vars[name]
+		if !ok {
+			if strict {
+				return "", fmt.Errorf("%w: %s", ErrMissingTemplateVar, name)
+			}
+			value = template[i : i+2+end]
+		}
+		b.WriteString(value)
+		i += 1 + end
+	}
+	return b.String(), nil
+}
+
+// How many more bytes the alert body can grow by before the payload exceeds
+// limit, given the other fields set. The bytes are counted JSON encoded: a
+// character JSON escapes counts as its escape, e.g. 2 for a quote and 6 for
+// <, > and &. Returns 0 if the payload is already at or over limit, or
+// doesn't marshal.
+func (l *Payload) MaxBodyLength(limit int) int {
+	p := *l
+	grown := 0
+	if p.Aps.body() == "" {
+		// measure with the alert key present, its body one byte long
+		p.Aps.AlertString = "x"
+		grown = 1
+	}
+	j, err := p.MarshalJSON()
+	if err != nil || len(j)-grown >= limit {
+		return 0
+	}
+	return limit - len(j) + grown
+}
+
+// What TruncateBody ends a shortened body with.
+const ellipsis = "\u2026"
+
+// Shorten the alert body, at a character boundary and ending in an ellipsis,
+// until the payload marshals to at most limit bytes. Nothing but the body is
+// changed. Returns whether the payload fits now; one that doesn't fit even
+// without its body, or doesn't marshal, is left as it is.
+func (l *Payload) TruncateBody(limit int) bool {
+	fits := func() bool {
+		j, err := l.MarshalJSON()
+		return err == nil && len(j) <= limit
+	}
+	body := &l.Aps.AlertString
+	if d := l.Aps.AlertDictionary; d != nil && d.Body != "" {
+		body = &d.Body
+	}
+	original := *body
+	if original == "" || fits() {
+		return fits()
+	}
+	*body = ellipsis
+	if !fits() {
+		*body = original
+		return false
+	}
+	for cut := len(original); cut > 0; {
+		_, size := utf8.DecodeLastRuneInString(original[:cut])
+		cut -= size
+		*body = original[:cut] + ellipsis
+		if fits() {
+			return true
+		}
+	}
+	return true
+}
+
+// Marshal the payload. Its top level keys, aps and the custom ones, are
+// sorted like encoding/json sorts map keys, so the same payload always
+// marshals to the same bytes (unless SetJSONMarshaler's marshal doesn't sort).
 func (l Payload) MarshalJSON() ([]byte, error) {
-	if l.customProperty == nil {
-		l.customProperty = make(map[string]interface{})
+	if l.mdm != "" {
+		return marshalJSON(map[string]string{"mdm": l.mdm})
+	}
+	property := make(map[string]interface{})
+	if l.customData != nil {
+		j, err := marshalJSON(l.customData)
+		if err != nil {
+			return nil, err
+		}
+		var data map[string]json.RawMessage
+		if err := json.Unmarshal(j, &data); err != nil {
+			return nil, fmt.Errorf("custom data isn't a json object: %s", err)
+		}
+		for k, v := range data {
+			property[k] = v
+		}
+	}
+	for k, v := range l.customProperty {
+		property[k] = v
+	}
+	apsKey := l.apsKey
+	if apsKey == "" {
+		apsKey = "aps"
 	}
-	l.customProperty["aps"] = l.Aps
-	return json.Marshal(l.customProperty)
+	property[apsKey] = l.Aps
+	return marshalJSON(property)
 }
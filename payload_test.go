@@ -1,8 +1,12 @@
 package apns
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"strings"
 	"testing"
+	"unicode/utf8"
 )
 
 func TestAlertMarshal(t *testing.T) {
@@ -162,3 +166,516 @@ func TestPayloadMarshal(t *testing.T) {
 		}
 	}
 }
+
+func TestAlertDictionaryMarshal(t *testing.T) {
+	{
+		alert := AlertDictionary{}
+		alert.LockKey = "GAME_PLAY_REQUEST_FORMAT"
+		alert.LockArgs = []string{"Jenna", "Frank"}
+		j, err := json.Marshal(alert)
+		if err != nil {
+			t.Fatalf("can't marshal to json: %s", err)
+		}
+		if got, expect := string(j), `{"loc-key":"GAME_PLAY_REQUEST_FORMAT","loc-args":["Jenna","Frank"]}`; got != expect {
+			t.Errorf("got: %s, expect: %s", got, expect)
+		}
+	}
+
+	{
+		alert := AlertDictionary{}
+		alert.LockArgs = []string{"Jenna", "Frank"}
+		if _, err := json.Marshal(alert); err == nil {
+			t.Errorf("loc-args without loc-key should fail")
+		}
+	}
+
+	{
+		payload := &Payload{}
+		payload.Aps.AlertDictionary = &AlertDictionary{Body: "Bob wants to play poker", ActionLockKey: "PLAY"}
+		payload.Aps.Badge = 5
+		j, err := payload.MarshalJSON()
+		if err != nil {
+			t.Fatalf("can't marshal to json: %s", err)
+		}
+		if got, expect := string(j), `{"aps":{"alert":{"body":"Bob wants to play poker","action-loc-key":"PLAY"},"badge":5}}`; got != expect {
+			t.Errorf("got: %s, expect: %s", got, expect)
+		}
+	}
+
+	{
+		n := testNotification(testToken(0x01), "")
+		n.Payload.Aps.AlertDictionary = &AlertDictionary{LockArgs: []string{"Jenna"}}
+		var e *MarshalError
+		if err := n.Validate(); !errors.As(err, &e) {
+			t.Errorf("got: %v, expect a MarshalError for loc-args without loc-key", err)
+		}
+	}
+}
+
+func TestAlertShape(t *testing.T) {
+	for _, c := range []struct {
+		aps    Aps
+		expect string
+	}{
+		{Aps{}, `{}`},
+		{Aps{AlertString: "hi"}, `{"alert":"hi"}`},
+		{Aps{AlertDictionary: &AlertDictionary{Body: "hi"}}, `{"alert":"hi"}`},
+		{Aps{AlertString: "ignored", AlertDictionary: &AlertDictionary{Body: "hi"}}, `{"alert":"hi"}`},
+		{Aps{AlertString: "hi", AlertDictionary: &AlertDictionary{}}, `{"alert":"hi"}`},
+		{Aps{AlertString: "hi", ForceAlertDict: true}, `{"alert":{"body":"hi"}}`},
+		{Aps{ForceAlertDict: true}, `{"alert":{}}`},
+		{Aps{AlertString: "hi", AlertDictionary: &AlertDictionary{LockKey: "KEY"}}, `{"alert":{"body":"hi","loc-key":"KEY"}}`},
+		{Aps{AlertDictionary: &AlertDictionary{LockKey: "KEY", LockArgs: []string{"Bob"}}}, `{"alert":{"loc-key":"KEY","loc-args":["Bob"]}}`},
+		{Aps{AlertDictionary: &AlertDictionary{Body: "hi", LaunchImage: "a.png"}}, `{"alert":{"body":"hi","launch-image":"a.png"}}`},
+	} {
+		j, err := json.Marshal(c.aps)
+		if err != nil {
+			t.Fatalf("can't marshal to json: %s", err)
+		}
+		if got := string(j); got != c.expect {
+			t.Errorf("got: %s, expect: %s", got, c.expect)
+		}
+	}
+}
+
+func TestPayloadEmptyAlert(t *testing.T) {
+	empty := &Payload{}
+	empty.Aps.AlertString = "hi"
+	empty.Aps.AlertDictionary = &AlertDictionary{LockKey: "KEY"}
+	empty.SetEmptyAlert()
+	for _, c := range []struct {
+		p      *Payload
+		expect string
+	}{
+		{empty, `{"aps":{"alert":{}}}`},
+		{&Payload{}, `{"aps":{}}`},
+		{&Payload{Aps: Aps{ContentAvailable: true}}, `{"aps":{"content-available":1}}`},
+	} {
+		j, err := json.Marshal(c.p)
+		if err != nil {
+			t.Fatalf("can't marshal to json: %s", err)
+		}
+		if got := string(j); got != c.expect {
+			t.Errorf("got: %s, expect: %s", got, c.expect)
+		}
+	}
+}
+
+func TestPayloadGolden(t *testing.T) {
+	p := &Payload{}
+	p.Aps.AlertDictionary = &AlertDictionary{
+		Body:          "hi",
+		LockKey:       "KEY",
+		LockArgs:      []string{"Bob"},
+		ActionLockKey: "VIEW",
+		LaunchImage:   "a.png",
+	}
+	p.Aps.Badge = 3
+	p.Aps.Sound = SoundDefault
+	p.SetCustom("zoo", 1)
+	p.SetCustom("bar", "x")
+	p.SetCustomData(map[string]int{"abc": 2})
+	expect := `{"abc":2,"aps":{"alert":{"body":"hi","loc-key":"KEY","loc-args":["Bob"],` +
+		`"action-loc-key":"VIEW","launch-image":"a.png"},"badge":3,"sound":"default"},"bar":"x","zoo":1}`
+	for i := 0; i < 10; i++ {
+		j, err := json.Marshal(p)
+		if err != nil {
+			t.Fatalf("can't marshal to json: %s", err)
+		}
+		if got := string(j); got != expect {
+			t.Fatalf("got: %s, expect: %s", got, expect)
+		}
+	}
+}
+
+func TestApsSound(t *testing.T) {
+	for _, c := range []struct {
+		aps    Aps
+		expect string
+	}{
+		{Aps{AlertString: "hello"}, `{"alert":"hello"}`},
+		{Aps{AlertString: "hello", Sound: SoundDefault}, `{"alert":"hello","sound":"default"}`},
+		{Aps{AlertString: "hello", Silent: true}, `{"alert":"hello","sound":""}`},
+		{Aps{AlertString: "hello", Sound: SoundDefault, Silent: true}, `{"alert":"hello","sound":""}`},
+		// a sound without an alert plays without a banner, and isn't a
+		// content-available background push
+		{Aps{Sound: "ping.caf"}, `{"sound":"ping.caf"}`},
+		{Aps{Sound: "ping.caf", ContentAvailable: true}, `{"sound":"ping.caf","content-available":1}`},
+		{Aps{ContentAvailable: true}, `{"content-available":1}`},
+		// updates the badge in the background
+		{Aps{Badge: 3, ContentAvailable: true}, `{"badge":3,"content-available":1}`},
+	} {
+		j, err := json.Marshal(c.aps)
+		if err != nil {
+			t.Fatalf("can't marshal to json: %s", err)
+		}
+		if got := string(j); got != c.expect {
+			t.Errorf("got: %s, expect: %s", got, c.expect)
+		}
+	}
+}
+
+func TestPayloadCustomData(t *testing.T) {
+	type Sender struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	}
+	type Data struct {
+		Kind   string `json:"kind"`
+		Sender Sender `json:"sender"`
+		Aps    string `json:"aps"`
+	}
+
+	{
+		payload := Payload{}
+		payload.Aps.AlertString = "hello"
+		payload.SetCustomData(Data{Kind: "message", Sender: Sender{7, "Bob"}, Aps: "ignored"})
+		j, err := json.Marshal(payload)
+		if err != nil {
+			t.Fatalf("can't marshal to json: %s", err)
+		}
+		if got, expect := string(j), `{"aps":{"alert":"hello"},"kind":"message","sender":{"id":7,"name":"Bob"}}`; got != expect {
+			t.Errorf("got: %s, expect: %s", got, expect)
+		}
+	}
+
+	{
+		payload := Payload{}
+		payload.SetCustomData(Data{Kind: "message"})
+		payload.SetCustom("kind", "override")
+		j, err := json.Marshal(payload)
+		if err != nil {
+			t.Fatalf("can't marshal to json: %s", err)
+		}
+		if got, expect := string(j), `{"aps":{},"kind":"override","sender":{"id":0,"name":""}}`; got != expect {
+			t.Errorf("got: %s, expect: %s", got, expect)
+		}
+	}
+
+	{
+		payload := Payload{}
+		payload.SetCustomData([]int{1, 2})
+		if _, err := json.Marshal(payload); err == nil {
+			t.Errorf("custom data that isn't an object should fail")
+		}
+	}
+}
+
+func TestPayloadFrom(t *testing.T) {
+	type Data struct {
+		Kind  string `json:"kind"`
+		Count int    `json:"count,omitempty"`
+	}
+
+	for _, c := range []struct {
+		custom interface{}
+		expect string
+	}{
+		{Data{Kind: "message", Count: 2}, `{"aps":{"alert":"hello","badge":1},"count":2,"kind":"message"}`},
+		{&Data{Kind: "message"}, `{"aps":{"alert":"hello","badge":1},"kind":"message"}`},
+		{nil, `{"aps":{"alert":"hello","badge":1}}`},
+	} {
+		p, err := PayloadFrom(Aps{AlertString: "hello", Badge: 1}, c.custom)
+		if err != nil {
+			t.Fatalf("payload error: %s", err)
+		}
+		j, err := json.Marshal(p)
+		if err != nil {
+			t.Fatalf("can't marshal to json: %s", err)
+		}
+		if got := string(j); got != c.expect {
+			t.Errorf("got: %s, expect: %s", got, c.expect)
+		}
+	}
+
+	if _, err := PayloadFrom(Aps{}, []int{1, 2}); err == nil {
+		t.Errorf("custom data that isn't an object should fail")
+	}
+}
+
+func TestCheckCustomKeys(t *testing.T) {
+	aps := &Payload{}
+	aps.SetCustom("aps", 1)
+	data := &Payload{}
+	data.SetCustomData(map[string]int{"aps": 1})
+	badge := &Payload{}
+	badge.SetCustom("badge", 1)
+	ok := &Payload{}
+	ok.SetCustom("thread", "t-1")
+	ok.SetCustomData(map[string]int{"count": 1})
+
+	for _, c := range []struct {
+		p      *Payload
+		expect string
+	}{
+		{aps, "aps"},
+		{data, "aps"},
+		{badge, "badge"},
+		{ok, ""},
+	} {
+		var e *ReservedKeyError
+		err := c.p.CheckCustomKeys()
+		if c.expect == "" {
+			if err != nil {
+				t.Errorf("got: %s, expect no error", err)
+			}
+		} else if !errors.As(err, &e) || e.Key != c.expect {
+			t.Errorf("got: %v, expect reserved key %s", err, c.expect)
+		}
+	}
+}
+
+func TestSetJSONMarshaler(t *testing.T) {
+	calls := 0
+	SetJSONMarshaler(func(v interface{}) ([]byte, error) {
+		calls++
+		return json.Marshal(v)
+	})
+	defer SetJSONMarshaler(nil)
+
+	payload := Payload{}
+	payload.Aps.AlertString = "hello"
+	j, err := payload.MarshalJSON()
+	if err != nil {
+		t.Fatalf("can't marshal to json: %s", err)
+	}
+	if got, expect := string(j), `{"aps":{"alert":"hello"}}`; got != expect {
+		t.Errorf("got: %s, expect: %s", got, expect)
+	}
+	if calls != 1 {
+		t.Errorf("marshaler called %d times, expect once", calls)
+	}
+}
+
+func BenchmarkPayloadMarshal(b *testing.B) {
+	payload := Payload{}
+	payload.Aps.AlertString = "hello world!"
+	payload.Aps.Badge = 1
+	payload.SetCustom("thread", "t-1234")
+
+	// skips escaping HTML, standing in for a faster library
+	custom := func(v interface{}) ([]byte, error) {
+		var buf bytes.Buffer
+		encoder := json.NewEncoder(&buf)
+		encoder.SetEscapeHTML(false)
+		if err := encoder.Encode(v); err != nil {
+			return nil, err
+		}
+		return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+	}
+
+	for _, c := range []struct {
+		name    string
+		marshal func(interface{}) ([]byte, error)
+	}{
+		{"default", nil},
+		{"custom", custom},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			SetJSONMarshaler(c.marshal)
+			defer SetJSONMarshaler(nil)
+			for i := 0; i < b.N; i++ {
+				if _, err := payload.MarshalJSON(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestMDMPayload(t *testing.T) {
+	payload := NewMDMPayload("8eb4f7b5-3ee8-4e4b-a5e3-1a0d5b8f6c21")
+	payload.Aps.AlertString = "ignored"
+	j, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("can't marshal to json: %s", err)
+	}
+	if got, expect := string(j), `{"mdm":"8eb4f7b5-3ee8-4e4b-a5e3-1a0d5b8f6c21"}`; got != expect {
+		t.Errorf("got: %s, expect: %s", got, expect)
+	}
+}
+
+func TestPayloadMaxBodyLength(t *testing.T) {
+	for _, c := range []struct {
+		payload func(p *Payload)
+		expect  int
+	}{
+		// {"aps":{"alert":""}}
+		{func(p *Payload) {}, 256 - 20},
+		{func(p *Payload) { p.Aps.AlertString = "hello" }, 256 - 25},
+		// {"aps":{"alert":"","badge":1,"sound":"default"}}
+		{func(p *Payload) { p.Aps.Badge, p.Aps.Sound = 1, SoundDefault }, 256 - 48},
+		// the quotes are escaped: {"aps":{"alert":"\"hi\""},"id":7}
+		{func(p *Payload) { p.Aps.AlertString = `"hi"`; p.SetCustom("id", 7) }, 256 - 33},
+		{func(p *Payload) { p.SetCustom("data", strings.Repeat("x", 300)) }, 0},
+		// the dictionary's body is the one sent: {"aps":{"alert":"hello"}}
+		{func(p *Payload) { p.Aps.AlertDictionary = &AlertDictionary{Body: "hello"} }, 256 - 25},
+	} {
+		payload := &Payload{}
+		c.payload(payload)
+		if got := payload.MaxBodyLength(256); got != c.expect {
+			t.Errorf("got: %d, expect: %d", got, c.expect)
+		}
+	}
+
+	// a body grown by MaxBodyLength fills the payload exactly
+	for _, body := range []func(p *Payload) *string{
+		func(p *Payload) *string { return &p.Aps.AlertString },
+		func(p *Payload) *string {
+			p.Aps.AlertDictionary = &AlertDictionary{Body: "hello"}
+			return &p.Aps.AlertDictionary.Body
+		},
+		func(p *Payload) *string {
+			p.Aps.AlertDictionary = &AlertDictionary{Body: "hello", LockKey: "GREETING"}
+			return &p.Aps.AlertDictionary.Body
+		},
+	} {
+		payload := &Payload{}
+		b := body(payload)
+		*b += strings.Repeat("x", payload.MaxBodyLength(256))
+		j, err := payload.MarshalJSON()
+		if err != nil {
+			t.Fatalf("marshal error: %s", err)
+		}
+		if len(j) != 256 {
+			t.Errorf("got %d bytes, expect 256: %s", len(j), j)
+		}
+	}
+}
+
+func TestTruncateBody(t *testing.T) {
+	for _, c := range []struct {
+		payload func(p *Payload)
+		fits    bool
+		body    func(p *Payload) string
+	}{
+		{func(p *Payload) { p.Aps.AlertString = "hello" }, true, func(p *Payload) string { return p.Aps.AlertString }},
+		{func(p *Payload) { p.Aps.AlertString = strings.Repeat("x", 300) }, true, func(p *Payload) string { return p.Aps.AlertString }},
+		// cut between characters, counting bytes
+		{func(p *Payload) { p.Aps.AlertString = strings.Repeat("é", 300) }, true, func(p *Payload) string { return p.Aps.AlertString }},
+		{func(p *Payload) {
+			p.Aps.AlertDictionary = &AlertDictionary{Body: strings.Repeat("x", 300), LockKey: "KEY"}
+		}, true, func(p *Payload) string { return p.Aps.AlertDictionary.Body }},
+		{func(p *Payload) {
+			p.Aps.AlertString = "hello"
+			p.SetCustom("data", strings.Repeat("x", 300))
+		}, false, func(p *Payload) string { return p.Aps.AlertString }},
+	} {
+		payload := &Payload{}
+		c.payload(payload)
+		before := c.body(payload)
+		if got := payload.TruncateBody(256); got != c.fits {
+			t.Errorf("%.10s: got: %t, expect: %t", before, got, c.fits)
+		}
+		j, _ := payload.MarshalJSON()
+		body := c.body(payload)
+		switch {
+		case !c.fits:
+			if body != before {
+				t.Errorf("got body %s, expect it unchanged", body)
+			}
+		case len(j) > 256:
+			t.Errorf("got %d bytes: %s", len(j), j)
+		case body != before && (!strings.HasSuffix(body, ellipsis) || !utf8.ValidString(body) || len(j) < 254):
+			t.Errorf("got body %s, %d bytes", body, len(j))
+		}
+	}
+}
+
+func TestRenderAlert(t *testing.T) {
+	vars := map[string]string{"name": "Ann", "count": "3", "unused": "x"}
+	for _, c := range []struct {
+		template string
+		expect   string
+	}{
+		{"Hi {name}, {count} new messages", "Hi Ann, 3 new messages"},
+		{"Hi {nickname}", "Hi {nickname}"},
+		{"{{name}} is {name}", "{name} is Ann"},
+		{"unclosed {name", "unclosed {name"},
+		{"{{name}", "{name}"},
+		{"}{name}{", "}Ann{"},
+		{"", ""},
+	} {
+		if got := RenderAlert(c.template, vars); got != c.expect {
+			t.Errorf("%q got: %q, expect: %q", c.template, got, c.expect)
+		}
+	}
+
+	{
+		payload := Payload{}
+		if err := payload.SetAlertTemplate("Hi {name}", vars); err != nil {
+			t.Fatalf("set error: %s", err)
+		}
+		if got, expect := payload.Aps.AlertString, "Hi Ann"; got != expect {
+			t.Errorf("got: %q, expect: %q", got, expect)
+		}
+		if err := payload.SetAlertTemplate("Hi {nickname}", vars); !errors.Is(err, ErrMissingTemplateVar) {
+			t.Errorf("got: %v, expect: %s", err, ErrMissingTemplateVar)
+		}
+		if got, expect := payload.Aps.AlertString, "Hi Ann"; got != expect {
+			t.Errorf("got: %q, expect unchanged %q", got, expect)
+		}
+	}
+}
+
+func TestPayloadAccessors(t *testing.T) {
+	payload := Payload{}
+	payload.Aps.AlertString = "hello"
+	payload.Aps.Badge = 3
+	payload.SetCustomData(struct {
+		Thread string `json:"thread"`
+		Aps    string `json:"aps"`
+	}{"t-1", "ignored"})
+	payload.SetCustom("acme", 1)
+
+	if got, expect := payload.Alert(), "hello"; got != expect {
+		t.Errorf("got alert: %q, expect: %q", got, expect)
+	}
+	payload.Aps.AlertDictionary = &AlertDictionary{Body: "hi"}
+	if got, expect := payload.Alert(), "hi"; got != expect {
+		t.Errorf("got alert: %q, expect: %q", got, expect)
+	}
+	payload.Aps.AlertDictionary = nil
+	if got, expect := payload.Badge(), 3; got != expect {
+		t.Errorf("got badge: %d, expect: %d", got, expect)
+	}
+	custom := payload.Custom()
+	if len(custom) != 2 {
+		t.Errorf("got custom: %v, expect 2 keys", custom)
+	}
+	if got, ok := custom["thread"].(json.RawMessage); !ok || string(got) != `"t-1"` {
+		t.Errorf("got thread: %v", custom["thread"])
+	}
+	if got := custom["acme"]; got != 1 {
+		t.Errorf("got acme: %v, expect: 1", got)
+	}
+
+	custom["acme"] = 2
+	if got := payload.GetCustom("acme"); got != 1 {
+		t.Errorf("changing Custom() changed the payload, got: %v", got)
+	}
+}
+
+func TestPayloadApsKey(t *testing.T) {
+	payload := Payload{}
+	payload.Aps.AlertString = "hello"
+	payload.SetCustom("acme", 1)
+
+	payload.SetApsKey("relay_aps")
+	j, err := payload.MarshalJSON()
+	if err != nil {
+		t.Fatalf("marshal error: %s", err)
+	}
+	if got, expect := string(j), `{"acme":1,"relay_aps":{"alert":"hello"}}`; got != expect {
+		t.Errorf("got: %s, expect: %s", got, expect)
+	}
+
+	payload.SetApsKey("")
+	j, err = payload.MarshalJSON()
+	if err != nil {
+		t.Fatalf("marshal error: %s", err)
+	}
+	if got, expect := string(j), `{"acme":1,"aps":{"alert":"hello"}}`; got != expect {
+		t.Errorf("got: %s, expect: %s", got, expect)
+	}
+}
@@ -0,0 +1,88 @@
+package apns
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// Most device tokens a per-token rate limit keeps track of; the least
+// recently sent to is forgotten beyond that, starting over with a full
+// burst.
+const maxLimitedTokens = 10000
+
+// Token buckets for a per-token rate limit, see WithTokenRateLimit.
+type tokenLimiter struct {
+	lock    sync.Mutex
+	burst   float64
+	rate    float64 // notifications per second
+	wait    bool
+	recent  *list.List // of *tokenBucket, most recently sent to first
+	buckets map[string]*list.Element
+}
+
+type tokenBucket struct {
+	token  string
+	tokens float64
+	at     time.Time
+}
+
+func newTokenLimiter(n int, per time.Duration, wait bool) *tokenLimiter {
+	return &tokenLimiter{
+		burst:   float64(n),
+		rate:    float64(n) / per.Seconds(),
+		wait:    wait,
+		recent:  list.New(),
+		buckets: make(map[string]*list.Element),
+	}
+}
+
+// Take a send to token at now, returning how long to wait before sending, or
+// ErrTokenRateLimited if over the limit and not waiting.
+func (l *tokenLimiter) take(token string, now time.Time) (time.Duration, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	var b *tokenBucket
+	if e, ok := l.buckets[token]; ok {
+		l.recent.MoveToFront(e)
+		b = e.Value.(*tokenBucket)
+		b.tokens += now.Sub(b.at).Seconds() * l.rate
+		if b.tokens > l.burst {
+			b.tokens = l.burst
+		}
+	} else {
+		b = &tokenBucket{token: token, tokens: l.burst}
+		l.buckets[token] = l.recent.PushFront(b)
+		if l.recent.Len() > maxLimitedTokens {
+			oldest := l.recent.Remove(l.recent.Back()).(*tokenBucket)
+			delete(l.buckets, oldest.token)
+		}
+	}
+	b.at = now
+	if b.tokens < 1 && !l.wait {
+		return 0, ErrTokenRateLimited
+	}
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0, nil
+	}
+	return time.Duration(-b.tokens / l.rate * float64(time.Second)), nil
+}
+
+// Wait until a send to token is within the limit, or fail with
+// ErrTokenRateLimited, or ctx's error if it's done first.
+func (l *tokenLimiter) allow(ctx context.Context, token string) error {
+	wait, err := l.take(token, time.Now())
+	if err != nil || wait == 0 {
+		return err
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
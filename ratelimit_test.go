@@ -0,0 +1,84 @@
+package apns
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTokenLimiter(t *testing.T) {
+	l := newTokenLimiter(2, time.Second, false)
+	now := time.Now()
+	for _, c := range []struct {
+		token  string
+		after  time.Duration
+		expect error
+	}{
+		{"a", 0, nil},
+		{"a", 0, nil},
+		{"a", 0, ErrTokenRateLimited},
+		{"b", 0, nil},
+		// half a second refills one
+		{"a", 500 * time.Millisecond, nil},
+		{"a", 500 * time.Millisecond, ErrTokenRateLimited},
+	} {
+		if _, got := l.take(c.token, now.Add(c.after)); got != c.expect {
+			t.Errorf("%s after %s: got: %v, expect: %v", c.token, c.after, got, c.expect)
+		}
+	}
+
+	{
+		l := newTokenLimiter(1, time.Second, true)
+		l.take("a", now)
+		if wait, err := l.take("a", now); err != nil || wait != time.Second {
+			t.Errorf("got: %s, %v, expect to wait 1s", wait, err)
+		}
+	}
+
+	{
+		for i := 0; i < maxLimitedTokens+1; i++ {
+			l.take(fmt.Sprint(i), now)
+		}
+		if got := len(l.buckets); got != maxLimitedTokens {
+			t.Errorf("got %d tokens, expect %d", got, maxLimitedTokens)
+		}
+	}
+}
+
+func TestTokenRateLimit(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+
+	{
+		apn := newTestApn(t, s, time.Second, WithTokenRateLimit(2, time.Minute, false))
+		for i, expect := range []error{nil, nil, ErrTokenRateLimited} {
+			if got := apn.Send(testNotification(testToken(0x01), "hello")); got != expect {
+				t.Errorf("send %d: got: %v, expect: %v", i, got, expect)
+			}
+		}
+		if err := apn.Send(testNotification(testToken(0x02), "hello")); err != nil {
+			t.Errorf("got: %s, expect another token to be sent", err)
+		}
+		apn.Close()
+	}
+
+	{
+		apn := newTestApn(t, s, time.Second, WithTokenRateLimit(1, 100*time.Millisecond, true))
+		defer apn.Close()
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			if err := apn.Send(testNotification(testToken(0x01), "hello")); err != nil {
+				t.Fatalf("send error: %s", err)
+			}
+		}
+		if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+			t.Errorf("took %s, expect the sends to wait", elapsed)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if _, err := apn.SendAndWait(ctx, testNotification(testToken(0x01), "hello")); err != context.DeadlineExceeded {
+			t.Errorf("got: %v, expect: %s", err, context.DeadlineExceeded)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package apns
+
+import (
+	"sync"
+)
+
+// Anything sending notifications, like an *Apn, or a *Recorder to test code
+// that sends. Type assert to the concrete type for the rest of its methods.
+type Sender interface {
+	Send(notification *Notification) error
+	// The errors reported after Send returned, see Apn.ErrorChan.
+	GetErrorChan() <-chan error
+	Close() error
+}
+
+var _ Sender = (*Apn)(nil)
+
+// A Sender recording the notifications sent to it instead of sending them,
+// to assert what code using a Sender would have sent. The zero Recorder is
+// ready to use and safe for concurrent use.
+type Recorder struct {
+	lock     sync.Mutex
+	recorded []*Notification
+	errs     chan error
+	closed   bool
+}
+
+// Record a copy of notification, returning the error sending it with an Apn
+// would, see Notification.Validate. Notifications that fail aren't recorded.
+func (r *Recorder) Send(notification *Notification) error {
+	if notification == nil {
+		return ErrNilNotification
+	}
+	if err := notification.Validate(); err != nil {
+		return err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return ErrClosed
+	}
+	r.recorded = append(r.recorded, notification.Clone())
+	return nil
+}
+
+// The notifications recorded so far, in the order they were sent.
+func (r *Recorder) Recorded() []*Notification {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]*Notification(nil), r.recorded...)
+}
+
+// Forget the notifications recorded so far.
+func (r *Recorder) Reset() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.recorded = nil
+}
+
+// A channel nothing is sent on, as a Recorder has no errors to report after
+// Send returns.
+func (r *Recorder) GetErrorChan() <-chan error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.errs == nil {
+		r.errs = make(chan error)
+	}
+	return r.errs
+}
+
+// Stop recording: Send returns ErrClosed afterwards.
+func (r *Recorder) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.closed = true
+	return nil
+}
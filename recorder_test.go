@@ -0,0 +1,70 @@
+package apns
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecorder(t *testing.T) {
+	var r Recorder
+	var sender Sender = &r
+
+	n := testNotification(testToken(0x01), "hello")
+	if err := sender.Send(n); err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+	n.Payload.Aps.AlertString = "changed"
+	if err := sender.Send(testNotification("0102", "hello")); err != ErrInvalidTokenSize {
+		t.Errorf("got: %v, expect: %s", err, ErrInvalidTokenSize)
+	}
+	if err := sender.Send(testNotification(testToken(0x02), "bye")); err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+
+	recorded := r.Recorded()
+	if len(recorded) != 2 {
+		t.Fatalf("got %d recorded, expect 2", len(recorded))
+	}
+	for i, expect := range []struct {
+		token, alert string
+	}{
+		{testToken(0x01), "hello"},
+		{testToken(0x02), "bye"},
+	} {
+		if got := recorded[i]; got.DeviceToken != expect.token || got.Payload.Alert() != expect.alert {
+			t.Errorf("got: %s %q, expect: %s %q", got.DeviceToken, got.Payload.Alert(), expect.token, expect.alert)
+		}
+	}
+
+	r.Reset()
+	if got := len(r.Recorded()); got != 0 {
+		t.Errorf("got %d recorded after reset, expect 0", got)
+	}
+}
+
+func TestSender(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+
+	for _, sender := range []Sender{newTestApn(t, s, time.Second), &Recorder{}} {
+		go func(errs <-chan error) {
+			for range errs {
+			}
+		}(sender.GetErrorChan())
+		if err := sender.Send(testNotification(testToken(0x01), "hello")); err != nil {
+			t.Errorf("%T: send error: %s", sender, err)
+		}
+		if err := sender.Close(); err != nil {
+			t.Errorf("%T: close error: %s", sender, err)
+		}
+		if err := sender.Send(testNotification(testToken(0x01), "hello")); err != ErrClosed {
+			t.Errorf("%T: got: %v, expect: %s", sender, err, ErrClosed)
+		}
+		if r, ok := sender.(*Recorder); ok && len(r.Recorded()) != 1 {
+			t.Errorf("got %d recorded, expect 1", len(r.Recorded()))
+		}
+		if _, ok := sender.(*Apn); ok {
+			<-s.frames
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package apns
+
+import (
+	"sync"
+)
+
+// Status Apple replies with when a device token is invalid.
+const statusInvalidToken = 8
+
+// Status Apple replies with when it encountered no errors.
+const statusNoErrors = 0
+
+// A Service sends notifications through an Apn and consumes its ErrorChan.
+// Apn already reconnects and resends what Apple dropped after an error, so a
+// Service only adds token cleanup: every token Apple reports as invalid is
+// passed to onInvalidToken, and all other errors are passed to onError.
+// Which errors mean an invalid token is up to the classifier, see
+// WithClassifier.
+type Service struct {
+	apn            *Apn
+	onInvalidToken func(token string)
+	onError        func(err error)
+	done           chan struct{}
+	closeOnce      sync.Once
+}
+
+// New Service sending with apn. onError may be nil to ignore other errors.
+func NewService(apn *Apn, onInvalidToken func(token string), onError func(err error)) *Service {
+	s := &Service{
+		apn:            apn,
+		onInvalidToken: onInvalidToken,
+		onError:        onError,
+		done:           make(chan struct{}),
+	}
+	go s.handleErrors()
+	return s
+}
+
+// Send a notification to iOS
+func (s *Service) Send(notification *Notification) error {
+	return s.apn.Send(notification)
+}
+
+// Close the Apn and stop handling its errors.
+func (s *Service) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	return s.apn.Close()
+}
+
+func (s *Service) handleErrors() {
+	for {
+		var err error
+		select {
+		case err = <-s.apn.ErrorChan:
+		case <-s.done:
+			return
+		}
+		e, ok := err.(NotificationError)
+		// only Apple's responses say anything about the token
+		if ok && e.OtherError == nil && e.Command == 8 && e.notification != nil && s.apn.classify(e) == RemoveToken {
+			s.onInvalidToken(e.notification.DeviceToken)
+			continue
+		}
+		if s.onError != nil {
+			s.onError(err)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package apns
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestServiceInvalidToken(t *testing.T) {
+	bad := testToken(0xbb)
+	s := newTestServer(t, func(f testFrame) uint8 {
+		if f.token == bad {
+			return 8
+		}
+		return 0
+	})
+	defer s.Close()
+
+	invalid := make(chan string, 1)
+	service := NewService(newTestApn(t, s, time.Second), func(token string) {
+		invalid <- token
+	}, nil)
+
+	if err := service.Send(testNotification(bad, "hello")); err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+	select {
+	case got := <-invalid:
+		if got != bad {
+			t.Errorf("got: %s, expect: %s", got, bad)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("invalid token not reported")
+	}
+}
+
+func ExampleService() {
+	cert, _ := ioutil.ReadFile("apns_dev_cert.pem")
+	key, _ := ioutil.ReadFile("apns_dev_key.pem")
+	apn, err := NewWithOptions(cert, key, "gateway.sandbox.push.apple.com:2195", WithTimeout(time.Minute))
+	if err != nil {
+		fmt.Printf("connect error: %s\n", err)
+		return
+	}
+
+	service := NewService(apn, func(token string) {
+		// Apple rejected the token, stop sending to it.
+		fmt.Printf("remove token %s\n", token)
+	}, func(err error) {
+		fmt.Printf("apns error: %s\n", err)
+	})
+	defer service.Close()
+
+	payload := &Payload{}
+	payload.Aps.AlertString = "hello world!"
+	for _, token := range []string{"device token 1", "device token 2"} {
+		err := service.Send(&Notification{DeviceToken: token, Payload: payload})
+		if err != nil {
+			fmt.Printf("send error: %s\n", err)
+		}
+	}
+}
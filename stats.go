@@ -0,0 +1,64 @@
+package apns
+
+// A snapshot of what an Apn has sent.
+type Stats struct {
+	// Notifications written to the connection, and their bytes.
+	Sent  uint64
+	Bytes uint64
+	// Notifications that failed to send, not counting Apple's error
+	// responses.
+	Failed uint64
+	// Connections made.
+	Reconnects uint64
+	// Number of error responses from Apple by status, e.g. 8 for an
+	// invalid token.
+	StatusCounts map[uint8]uint64
+}
+
+// Snapshot of the stats so far. The returned Stats is a copy and safe to keep.
+func (a *Apn) Stats() Stats {
+	a.statsLock.Lock()
+	defer a.statsLock.Unlock()
+	return a.snapshotStats()
+}
+
+// Zero the stats, returning a snapshot of them right before. Counting and
+// resetting share a lock, so every count is in exactly one snapshot
+// returned by ResetStats; use it instead of Stats followed by ResetStats to
+// measure per-interval rates.
+func (a *Apn) ResetStats() Stats {
+	a.statsLock.Lock()
+	defer a.statsLock.Unlock()
+	s := a.snapshotStats()
+	a.stats = Stats{}
+	return s
+}
+
+func (a *Apn) snapshotStats() Stats {
+	s := a.stats
+	s.StatusCounts = make(map[uint8]uint64, len(a.stats.StatusCounts))
+	for status, count := range a.stats.StatusCounts {
+		s.StatusCounts[status] = count
+	}
+	return s
+}
+
+// Update the stats with count. A Broadcast sibling counts into its parent's.
+func (a *Apn) count(count func(s *Stats)) {
+	if a.parent != nil {
+		a.parent.count(count)
+		return
+	}
+	a.statsLock.Lock()
+	defer a.statsLock.Unlock()
+	count(&a.stats)
+}
+
+func (a *Apn) countStatus(status uint8) {
+	a.count(func(s *Stats) {
+		if s.StatusCounts == nil {
+			s.StatusCounts = make(map[uint8]uint64)
+		}
+		s.StatusCounts[status]++
+	})
+}
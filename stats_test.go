@@ -0,0 +1,87 @@
+package apns
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStatsStatusCounts(t *testing.T) {
+	bad := testToken(0xbb)
+	s := newTestServer(t, func(f testFrame) uint8 {
+		if f.token == bad {
+			return 8
+		}
+		return 0
+	})
+	defer s.Close()
+	apn := newTestApn(t, s, time.Second)
+	defer apn.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := apn.Send(testNotification(bad, "bad")); err != nil {
+			t.Fatalf("send error: %s", err)
+		}
+		for {
+			if e, ok := (<-apn.ErrorChan).(NotificationError); ok && e.Command == 8 {
+				break
+			}
+		}
+	}
+
+	stats := apn.Stats()
+	if got, expect := stats.StatusCounts[8], uint64(2); got != expect {
+		t.Errorf("got: %d, expect: %d", got, expect)
+	}
+	stats.StatusCounts[8] = 0
+	if got, expect := apn.Stats().StatusCounts[8], uint64(2); got != expect {
+		t.Errorf("snapshot not a copy, got: %d, expect: %d", got, expect)
+	}
+}
+
+func TestResetStats(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	apn := newTestApn(t, s, time.Second)
+	defer apn.Close()
+	go func() {
+		for range s.frames {
+		}
+	}()
+
+	const senders, sends = 4, 25
+	done := make(chan struct{})
+	var total Stats
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			got := apn.ResetStats()
+			total.Sent += got.Sent
+			total.Failed += got.Failed
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < sends; j++ {
+				apn.Send(testNotification(testToken(0x01), "hello"))
+				apn.Send(testNotification("0102", "bad"))
+			}
+		}()
+	}
+	wg.Wait()
+	<-done
+	got := apn.ResetStats()
+	total.Sent += got.Sent
+	total.Failed += got.Failed
+
+	if total.Sent != senders*sends || total.Failed != senders*sends {
+		t.Errorf("got sent: %d, failed: %d, expect %d each", total.Sent, total.Failed, senders*sends)
+	}
+	if got := apn.Stats(); got.Sent != 0 || got.Reconnects != 0 {
+		t.Errorf("got: %+v after reset, expect zeros", got)
+	}
+}
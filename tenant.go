@@ -0,0 +1,147 @@
+package apns
+
+import (
+	"sync"
+	"time"
+)
+
+// A MultiTenantSender sends on behalf of many apps, each with its own
+// certificate, over an Apn per tenant. The Apns are made on a tenant's first
+// send and closed once they've been unused for the idle time.
+type MultiTenantSender struct {
+	newApn  func(tenant string) (*Apn, error)
+	onError func(tenant string, err error)
+	idle    time.Duration
+
+	lock      sync.Mutex
+	tenants   map[string]*tenantApn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type tenantApn struct {
+	apn      *Apn
+	lastUsed time.Time
+}
+
+// New MultiTenantSender making a tenant's Apn with newApn, e.g. with
+// NewWithOptions and the tenant's certificate. Errors from a tenant's
+// ErrorChan are passed to onError, which may be nil to ignore them. An idle
+// of 0 (or less) never closes a tenant's Apn before Close.
+func NewMultiTenantSender(newApn func(tenant string) (*Apn, error), onError func(tenant string, err error), idle time.Duration) *MultiTenantSender {
+	m := &MultiTenantSender{
+		newApn:  newApn,
+		onError: onError,
+		idle:    idle,
+		tenants: make(map[string]*tenantApn),
+		done:    make(chan struct{}),
+	}
+	if idle > 0 {
+		go m.evict()
+	}
+	return m
+}
+
+// Send notification with tenant's Apn, making it first if needed.
+func (m *MultiTenantSender) Send(tenant string, notification *Notification) error {
+	apn, err := m.apn(tenant)
+	if err != nil {
+		return err
+	}
+	return apn.Send(notification)
+}
+
+// The Apn of tenant, made if there's none yet. It's made without holding
+// the lock, so other tenants' sends don't wait for its connect; if another
+// send to tenant made one meanwhile, that one is used.
+func (m *MultiTenantSender) apn(tenant string) (*Apn, error) {
+	m.lock.Lock()
+	if m.closed() {
+		m.lock.Unlock()
+		return nil, ErrClosed
+	}
+	if t, ok := m.tenants[tenant]; ok {
+		t.lastUsed = time.Now()
+		m.lock.Unlock()
+		return t.apn, nil
+	}
+	m.lock.Unlock()
+
+	apn, err := m.newApn(tenant)
+	if err != nil {
+		return nil, err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed() {
+		apn.Close()
+		return nil, ErrClosed
+	}
+	t, ok := m.tenants[tenant]
+	if ok {
+		apn.Close()
+	} else {
+		t = &tenantApn{apn: apn}
+		m.tenants[tenant] = t
+		go m.handleErrors(tenant, apn)
+	}
+	t.lastUsed = time.Now()
+	return t.apn, nil
+}
+
+func (m *MultiTenantSender) closed() bool {
+	select {
+	case <-m.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (m *MultiTenantSender) handleErrors(tenant string, apn *Apn) {
+	for {
+		select {
+		case err := <-apn.ErrorChan:
+			if m.onError != nil {
+				m.onError(tenant, err)
+			}
+		case <-apn.done:
+			return
+		}
+	}
+}
+
+// Close the Apns unused for the idle time, until Close.
+func (m *MultiTenantSender) evict() {
+	tick := time.NewTicker(m.idle / 2)
+	defer tick.Stop()
+	for {
+		select {
+		case now := <-tick.C:
+			m.lock.Lock()
+			for tenant, t := range m.tenants {
+				if now.Sub(t.lastUsed) >= m.idle {
+					t.apn.Close()
+					delete(m.tenants, tenant)
+				}
+			}
+			m.lock.Unlock()
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// Close every tenant's Apn. Send returns ErrClosed afterwards.
+func (m *MultiTenantSender) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.done)
+	})
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for tenant, t := range m.tenants {
+		t.apn.Close()
+		delete(m.tenants, tenant)
+	}
+	return nil
+}
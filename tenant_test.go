@@ -0,0 +1,109 @@
+package apns
+
+import (
+	"bytes"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMultiTenantSender(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	certPEM, keyPEM := testCertificate(t)
+	made := int32(0)
+	m := NewMultiTenantSender(func(tenant string) (*Apn, error) {
+		atomic.AddInt32(&made, 1)
+		apn := newTestApn(t, s, time.Second)
+		if tenant == "b" {
+			if err := apn.UpdateCertificate(certPEM, keyPEM); err != nil {
+				return nil, err
+			}
+		}
+		return apn, nil
+	}, nil, 300*time.Millisecond)
+	defer m.Close()
+
+	for _, c := range []struct {
+		tenant string
+		cert   []byte
+	}{
+		{"a", s.certPEM},
+		{"b", certPEM},
+	} {
+		if err := m.Send(c.tenant, testNotification(testToken(0x01), "hello")); err != nil {
+			t.Fatalf("send error: %s", err)
+		}
+		<-s.frames
+		if got := <-s.peers; !bytes.Equal(got.Raw, pemBytes(c.cert)) {
+			t.Errorf("tenant %s: server didn't get its certificate", c.tenant)
+		}
+	}
+
+	// reused while in use
+	if err := m.Send("a", testNotification(testToken(0x02), "hello")); err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+	<-s.frames
+	if got := atomic.LoadInt32(&made); got != 2 {
+		t.Errorf("got %d Apns, expect 2", got)
+	}
+	if got := atomic.LoadInt32(&s.accepted); got != 2 {
+		t.Errorf("got %d connections, expect 2", got)
+	}
+
+	// made again after idling out
+	time.Sleep(700 * time.Millisecond)
+	if err := m.Send("a", testNotification(testToken(0x03), "hello")); err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+	<-s.frames
+	if got := atomic.LoadInt32(&made); got != 3 {
+		t.Errorf("got %d Apns, expect 3", got)
+	}
+
+	m.Close()
+	if err := m.Send("a", testNotification(testToken(0x01), "hello")); err != ErrClosed {
+		t.Errorf("got: %v, expect: %s", err, ErrClosed)
+	}
+}
+
+func TestMultiTenantSenderMakesApnsConcurrently(t *testing.T) {
+	s := newTestServer(t, nil)
+	defer s.Close()
+	release := make(chan struct{})
+	m := NewMultiTenantSender(func(tenant string) (*Apn, error) {
+		if tenant == "slow" {
+			<-release
+		}
+		return newTestApn(t, s, time.Second), nil
+	}, nil, 0)
+	defer m.Close()
+
+	slow := make(chan error, 1)
+	go func() {
+		slow <- m.Send("slow", testNotification(testToken(0x01), "hello"))
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// making the slow tenant's Apn doesn't hold up the others
+	sent := make(chan error, 1)
+	go func() {
+		sent <- m.Send("a", testNotification(testToken(0x02), "hello"))
+	}()
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Fatalf("send error: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("send waited for another tenant's Apn")
+	}
+	close(release)
+	if err := <-slow; err != nil {
+		t.Fatalf("send error: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		<-s.frames
+	}
+}
@@ -0,0 +1,53 @@
+package apns
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// Strips the decoration device tokens often come with, e.g. the spaces and
+// angle brackets of an NSData description.
+var tokenDecoration = strings.NewReplacer(" ", "", "\t", "", "\n", "", "<", "", ">", "")
+
+// Decode a device token given as hex, with or without spaces and angle
+// brackets, or as base64. Hex is tried first, so a token that is valid as
+// both is decoded as hex. A token that doesn't decode to 32 bytes fails with
+// ErrInvalidTokenSize.
+func DecodeToken(token string) ([]byte, error) {
+	b, err := decodeToken(tokenDecoration.Replace(token))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != tokenBytes {
+		return nil, ErrInvalidTokenSize
+	}
+	return b, nil
+}
+
+func decodeToken(token string) ([]byte, error) {
+	if b, err := hex.DecodeString(token); err == nil {
+		return b, nil
+	}
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if b, err := encoding.DecodeString(token); err == nil {
+			return b, nil
+		}
+	}
+	return nil, errors.New("token is neither hex nor base64")
+}
+
+// Check token is a device token that can be sent to, in the sandbox or in
+// production. Tokens look the same in both, so only the format and length
+// are checked; sending to the wrong environment still fails with Apple's
+// invalid token status.
+func ValidateTokenForEnvironment(token string, sandbox bool) error {
+	_, err := DecodeToken(token)
+	return err
+}
+
+// Encode a device token as canonical lowercase hex.
+func EncodeToken(token []byte) string {
+	return hex.EncodeToString(token)
+}
@@ -0,0 +1,61 @@
+package apns
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestDecodeToken(t *testing.T) {
+	token := bytes.Repeat([]byte{0xab, 0x01}, 16)
+	hexToken := EncodeToken(token)
+
+	for _, c := range []struct {
+		in string
+		ok bool
+	}{
+		{hexToken, true},
+		{strings.ToUpper(hexToken), true},
+		{"<" + hexToken[:8] + " " + hexToken[8:16] + " " + hexToken[16:] + ">", true},
+		{base64.StdEncoding.EncodeToString(token), true},
+		{base64.RawURLEncoding.EncodeToString(token), true},
+		{"not a token!", false},
+	} {
+		got, err := DecodeToken(c.in)
+		if !c.ok {
+			if err == nil {
+				t.Errorf("%q got: %x, expect an error", c.in, got)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(got, token) {
+			t.Errorf("%q got: %x (%v), expect: %x", c.in, got, err, token)
+		}
+	}
+
+	if got, expect := EncodeToken(token), strings.Repeat("ab01", 16); got != expect {
+		t.Errorf("got: %s, expect: %s", got, expect)
+	}
+}
+
+func TestValidateTokenForEnvironment(t *testing.T) {
+	for _, c := range []struct {
+		token  string
+		expect error
+	}{
+		{strings.Repeat("ab", 32), nil},
+		{strings.Repeat("ab", 31), ErrInvalidTokenSize},
+		{strings.Repeat("ab", 33), ErrInvalidTokenSize},
+		{base64.StdEncoding.EncodeToString(make([]byte, 16)), ErrInvalidTokenSize},
+	} {
+		for _, sandbox := range []bool{true, false} {
+			if got := ValidateTokenForEnvironment(c.token, sandbox); got != c.expect {
+				t.Errorf("%s got: %v, expect: %v", c.token, got, c.expect)
+			}
+		}
+	}
+	if err := ValidateTokenForEnvironment("not a token!", true); err == nil || err == ErrInvalidTokenSize {
+		t.Errorf("got: %v, expect a format error", err)
+	}
+}